@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	resultsBegin = "<!-- steplib-git-check:results -->"
+	resultsEnd   = "<!-- /steplib-git-check:results -->"
+)
+
+type pullRequestAction func(lib *steplib, pr pullRequestModel) error
+
+// pullRequestActions maps the pull_request webhook actions to their handlers, other actions are ignored.
+var pullRequestActions = map[string]pullRequestAction{
+	"opened":      handleOpened,
+	"reopened":    handleReopened,
+	"synchronize": handleSynchronize,
+	"edited":      handleEdited,
+	"closed":      handleClosed,
+}
+
+func dispatchPullRequest(lib *steplib, pr pullRequestModel) error {
+	action, ok := pullRequestActions[pr.Action]
+	if !ok {
+		return nil
+	}
+
+	exists, err := isPRHasStepYML(lib, pr.Number)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return nil
+	}
+
+	return action(lib, pr)
+}
+
+func handleOpened(lib *steplib, pr pullRequestModel) error {
+	return revalidate(lib, pr, true)
+}
+
+func handleReopened(lib *steplib, pr pullRequestModel) error {
+	return revalidate(lib, pr, false)
+}
+
+func handleSynchronize(lib *steplib, pr pullRequestModel) error {
+	verdicts.invalidate(lib.fullName(), pr.Number)
+
+	// the pushed step.yml files might have new versions which need their own release links
+	return revalidate(lib, pr, false)
+}
+
+// revalidate reports the check results of the PR head and brings the PR body up to date.
+func revalidate(lib *steplib, pr pullRequestModel, notifyNewStep bool) error {
+	results, err := checkPR(lib, pr.Number, pr.PullRequest.Head.SHA)
+	if err != nil {
+		return err
+	}
+	storeVerdict(lib, pr.Number, pr.PullRequest.Head.SHA, results)
+
+	if err := lib.github.createCheckRun(newCheckRun(pr.PullRequest.Head.SHA, results)); err != nil {
+		logger.forPR(lib, pr).withError(err).warnf("failed to report check run")
+	}
+
+	return ensurePRBody(lib, pr, results, notifyNewStep)
+}
+
+func handleEdited(lib *steplib, pr pullRequestModel) error {
+	// title or base branch edits do not touch the badge
+	if pr.Changes.Body == nil {
+		return nil
+	}
+
+	results, err := checkPR(lib, pr.Number, pr.PullRequest.Head.SHA)
+	if err != nil {
+		return err
+	}
+
+	return ensurePRBody(lib, pr, results, false)
+}
+
+func handleClosed(lib *steplib, pr pullRequestModel) error {
+	if !pr.PullRequest.Merged {
+		return nil
+	}
+
+	steps, err := parseSteps(lib, pr.Number, pr.PullRequest.Head.SHA)
+	if err != nil {
+		return err
+	}
+
+	for _, step := range steps {
+		stepDefinition, version := step.Step, step.Version
+
+		if !lib.isOfficialSource(stepDefinition.Source.Git) || stepDefinition.Title == nil {
+			continue
+		}
+
+		key := announcementKey(lib, step.ID, version)
+		var posted announcement
+		found, err := db.get(bucketAnnouncements, key, &posted)
+		if err != nil {
+			return err
+		}
+		if found {
+			logger.forPR(lib, pr).forStep(step.ID, version).with("announced_pr", posted.PR).infof("release was already announced")
+			continue
+		}
+
+		title := *stepDefinition.Title + " v" + version
+		body, err := lib.github.releaseBody(stepDefinition.Source.Git, version)
+		if err != nil {
+			return err
+		}
+
+		// append git release url
+		body += "\n\n\n" + releaseURL(stepDefinition.Source.Git, version) + "\r\n\r\n"
+
+		if err := createDiscourseTopic(lib.Discourse, title, body); err != nil {
+			return err
+		}
+		logger.forPR(lib, pr).forStep(step.ID, version).infof("release announced")
+
+		if err := db.put(bucketAnnouncements, key, announcement{Repo: lib.fullName(), PR: pr.Number, Title: title, PostedAt: time.Now()}); err != nil {
+			return fmt.Errorf("failed to record the announcement of %s %s, error: %s", step.ID, version, err)
+		}
+	}
+
+	return nil
+}
+
+func releaseURL(giturl, version string) string {
+	return fmt.Sprintf("%s/releases/%s", strings.TrimSuffix(giturl, ".git"), version)
+}
+
+// resultsTable renders the per step results, wrapped in markers so the next update can replace it.
+func resultsTable(results []stepResult) string {
+	table := resultsBegin + "\r\n"
+	table += "| Step | Version | Tag check |\r\n"
+	table += "| --- | --- | --- |\r\n"
+
+	for _, result := range results {
+		verdict := ":white_check_mark: passed"
+		var messages []string
+		for _, failure := range result.Failures {
+			messages = append(messages, fmt.Sprintf(":x: %s: %s", failure.Title, failure.Message))
+		}
+		for _, warning := range result.Warnings {
+			messages = append(messages, fmt.Sprintf(":warning: %s: %s", warning.Title, warning.Message))
+		}
+		if len(messages) > 0 {
+			verdict = strings.Join(messages, "<br>")
+		}
+
+		table += fmt.Sprintf("| %s | %s | %s |\r\n", result.Step.ID, result.Step.Version, strings.Replace(verdict, "|", "\\|", -1))
+	}
+
+	return table + resultsEnd
+}
+
+// replaceResultsTable swaps the previously rendered results table of the body, or returns false if there is none.
+func replaceResultsTable(body, table string) (string, bool) {
+	begin := strings.Index(body, resultsBegin)
+	if begin == -1 {
+		return body, false
+	}
+
+	end := strings.Index(body[begin:], resultsEnd)
+	if end == -1 {
+		return body, false
+	}
+	end += begin + len(resultsEnd)
+
+	return body[:begin] + table + body[end:], true
+}
+
+// ensurePRBody prepends the badge, the release links and the results table to the PR body if any of them is missing,
+// and refreshes an outdated results table. The PR is left untouched if the body is up to date,
+// so the edited event caused by our own update is a no-op.
+func ensurePRBody(lib *steplib, pr pullRequestModel, results []stepResult, notifyNewStep bool) error {
+	body := pr.PullRequest.Body
+
+	missing := ""
+	if !strings.Contains(body, lib.badgeURL(pr.Number)) {
+		missing += fmt.Sprintf("![%s](%s)\r\n\r\n", lib.Templates.BadgeTitle, lib.badgeURL(pr.Number))
+	}
+
+	for _, result := range results {
+		step := result.Step
+		if lib.isOfficialSource(step.Step.Source.Git) && !strings.Contains(body, releaseURL(step.Step.Source.Git, step.Version)) {
+			missing += releaseURL(step.Step.Source.Git, step.Version) + "\r\n\r\n"
+		}
+	}
+
+	table := resultsTable(results)
+	body, replaced := replaceResultsTable(body, table)
+	if !replaced {
+		missing += table + "\r\n\r\n"
+	}
+
+	if missing == "" && body == pr.PullRequest.Body {
+		return nil
+	}
+
+	// a retried job must not overwrite the edits made since with the body of its payload
+	if pr.DeliveryID != "" {
+		var editedAt time.Time
+		edited, err := db.get(bucketBodyEdits, pr.DeliveryID, &editedAt)
+		if err != nil {
+			return err
+		}
+		if edited {
+			return nil
+		}
+	}
+
+	var notified bool
+	if _, err := db.get(bucketNotifications, notificationKey(lib, pr.Number), &notified); err != nil {
+		return err
+	}
+
+	notifications := ""
+	if notifyNewStep && !notified {
+		for _, result := range results {
+			newStep, err := isNewStep(lib, result.Step.ID)
+			if err != nil {
+				return fmt.Errorf("unable to check if %s is a new step, error: %s", result.Step.ID, err)
+			}
+
+			if newStep {
+				notifications = "\r\n\r\n" + lib.Templates.NewStep
+				break
+			}
+		}
+	}
+
+	if err := lib.github.updatePullRequestBody(pr.Number, missing+body+notifications); err != nil {
+		return fmt.Errorf("failed to update PR, ID: %d, error: %s", pr.Number, err)
+	}
+
+	if pr.DeliveryID != "" {
+		if err := db.put(bucketBodyEdits, pr.DeliveryID, time.Now()); err != nil {
+			return err
+		}
+	}
+	if notifications != "" {
+		if err := db.put(bucketNotifications, notificationKey(lib, pr.Number), true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// requireAdmin only lets through the requests carrying ADMIN_TOKEN as a bearer token,
+// the admin endpoints are disabled if it is not set.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv("ADMIN_TOKEN")
+		if token == "" {
+			respondWithJSON(w, http.StatusNotFound, apiError{Error: "admin endpoints are disabled"})
+			return
+		}
+
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			respondWithJSON(w, http.StatusUnauthorized, apiError{Error: "invalid admin token"})
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func (s *server) deadJobsHandler(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, s.jobs.deadJobs())
+}
+
+const defaultDeliveriesLimit = 50
+
+// deliveryDetails is a delivery with its processing log and recorded payload.
+type deliveryDetails struct {
+	deliveryRecord
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+func (s *server) deliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultDeliveriesLimit
+	}
+
+	records, err := recentDeliveries(limit)
+	if err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, records)
+}
+
+func (s *server) deliveryHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var details deliveryDetails
+	found, err := db.get(bucketDeliveries, id, &details.deliveryRecord)
+	if err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	if !found {
+		respondWithJSON(w, http.StatusNotFound, apiError{Error: "unknown delivery"})
+		return
+	}
+
+	if _, err := db.get(bucketPayloads, id, &details.Payload); err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, details)
+}
+
+// replayDeliveryHandler processes the recorded payload of a delivery again, as a new delivery.
+func (s *server) replayDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var record deliveryRecord
+	var payload json.RawMessage
+	found, err := db.get(bucketDeliveries, id, &record)
+	if err == nil && found {
+		found, err = db.get(bucketPayloads, id, &payload)
+	}
+	if err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	if !found {
+		respondWithJSON(w, http.StatusNotFound, apiError{Error: "unknown delivery or no recorded payload"})
+		return
+	}
+
+	var pr pullRequestModel
+	if err := json.Unmarshal(payload, &pr); err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+
+	lib, ok := s.steplibs.lookup(record.Repo)
+	if !ok {
+		respondWithJSON(w, http.StatusNotFound, apiError{Error: "unknown steplib repository: " + record.Repo})
+		return
+	}
+
+	s.replay(w, lib, pr, id)
+}
+
+// replayPRHandler runs the checks of an open PR again, or the release announcements of a merged one.
+func (s *server) replayPRHandler(w http.ResponseWriter, r *http.Request) {
+	number, err := strconv.Atoi(mux.Vars(r)["number"])
+	if err != nil || number <= 0 {
+		respondWithJSON(w, http.StatusBadRequest, apiError{Error: "invalid PR number"})
+		return
+	}
+
+	lib, ok := s.steplibs.lookup(r.URL.Query().Get("repo"))
+	if !ok {
+		respondWithJSON(w, http.StatusNotFound, apiError{Error: "unknown steplib repository"})
+		return
+	}
+
+	pullRequest, err := lib.github.pullRequest(number)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadGateway, apiError{Error: err.Error()})
+		return
+	}
+
+	pr := pullRequestModel{Action: "synchronize", Number: number, PullRequest: pullRequest}
+	if pr.PullRequest.State == "closed" {
+		pr.Action = "closed"
+	}
+
+	s.replay(w, lib, pr, "")
+}
+
+func (s *server) replay(w http.ResponseWriter, lib *steplib, pr pullRequestModel, replayOf string) {
+	// the recorded body may be stale or redacted, the actions have to see the current one,
+	// pullRequest revalidates the cached PR so an edit within the cache TTL is not missed either
+	current, err := lib.github.pullRequest(pr.Number)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadGateway, apiError{Error: err.Error()})
+		return
+	}
+	pr.PullRequest = current
+	pr.DeliveryID = fmt.Sprintf("replay-%d-%d", pr.Number, time.Now().UnixNano())
+
+	record := newDeliveryRecord(pr.DeliveryID, lib, pr)
+	record.ReplayOf = replayOf
+	if err := db.put(bucketDeliveries, pr.DeliveryID, record); err != nil {
+		respondWithJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+
+	if err := s.jobs.enqueue(newPullRequestJob(pr.DeliveryID, lib, pr)); err != nil {
+		finishDelivery(pr.DeliveryID, deliveryFailed)
+		respondWithJSON(w, http.StatusServiceUnavailable, apiError{Error: err.Error()})
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, record)
+}
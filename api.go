@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type apiStepCheck struct {
+	StepID     string         `json:"step_id"`
+	Version    string         `json:"version"`
+	Path       string         `json:"path"`
+	SourceGit  string         `json:"source_git"`
+	Commit     string         `json:"commit"`
+	TagSHA     string         `json:"tag_sha,omitempty"`
+	TagType    string         `json:"tag_type,omitempty"`
+	TagObjects []string       `json:"tag_objects,omitempty"`
+	Passed     bool           `json:"passed"`
+	Failures   []checkFailure `json:"failures"`
+	Warnings   []checkFailure `json:"warnings"`
+}
+
+type apiCheck struct {
+	PR     int            `json:"pr,omitempty"`
+	Passed bool           `json:"passed"`
+	Steps  []apiStepCheck `json:"steps"`
+}
+
+func newAPICheck(prNumber int, results []stepResult) apiCheck {
+	check := apiCheck{PR: prNumber, Passed: true, Steps: []apiStepCheck{}}
+
+	for _, result := range results {
+		stepCheck := apiStepCheck{
+			StepID:   result.Step.ID,
+			Version:  result.Step.Version,
+			Path:     result.Step.Path,
+			Passed:   len(result.Failures) == 0,
+			Failures: result.Failures,
+			Warnings: result.Warnings,
+		}
+		if source := result.Step.Step.Source; source != nil {
+			stepCheck.SourceGit, stepCheck.Commit = source.Git, source.Commit
+		}
+		if result.Tag != nil {
+			stepCheck.TagSHA = result.Tag.SHA
+			stepCheck.TagType = result.Tag.Type
+			stepCheck.TagObjects = result.Tag.TagObjects
+		}
+		if stepCheck.Failures == nil {
+			stepCheck.Failures = []checkFailure{}
+		}
+		if stepCheck.Warnings == nil {
+			stepCheck.Warnings = []checkFailure{}
+		}
+
+		check.Passed = check.Passed && stepCheck.Passed
+		check.Steps = append(check.Steps, stepCheck)
+	}
+
+	return check
+}
+
+func respondWithJSON(w http.ResponseWriter, status int, model interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(model); err != nil {
+		logger.withError(err).errorf("failed to write JSON response")
+	}
+}
+
+// apiCheckHandler serves the same validation tagHandler renders as a badge, as JSON.
+func (s *server) apiCheckHandler(w http.ResponseWriter, r *http.Request) {
+	prNumber, err := strconv.Atoi(mux.Vars(r)["number"])
+	if err != nil || prNumber <= 0 {
+		respondWithJSON(w, http.StatusBadRequest, apiError{Error: "invalid PR number"})
+		return
+	}
+
+	lib, ok := s.steplibs.lookup(r.URL.Query().Get("repo"))
+	if !ok {
+		respondWithJSON(w, http.StatusNotFound, apiError{Error: "unknown steplib repository"})
+		return
+	}
+
+	v, err := prVerdict(lib, prNumber)
+	if rateLimitErr, ok := err.(rateLimitError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(rateLimitErr.Reset).Seconds())+1))
+		respondWithJSON(w, http.StatusServiceUnavailable, apiError{Error: err.Error()})
+		return
+	}
+	if err == errNoStepYML {
+		respondWithJSON(w, http.StatusNotFound, apiError{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		// the error can carry the stderr of git or the responses of internal hosts, it is only logged
+		logger.with("repo", lib.fullName()).with("pr", prNumber).withError(err).errorf("failed to check PR")
+		respondWithJSON(w, http.StatusBadGateway, apiError{Error: "failed to check the PR"})
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, newAPICheck(prNumber, v.Results))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"time"
+)
+
+const (
+	badgeLabel = "TagCheck"
+
+	colorOk      = "#4c1"
+	colorError   = "#e05d44"
+	colorWarning = "#dfb317"
+
+	// badgeMaxAge lets GitHub's image proxy reuse a verdict for a while, the verdict itself is cached by head SHA.
+	badgeMaxAge = time.Minute
+
+	badgeFontSize = 11.0
+	// verdanaUnitsPerEm is the scale of verdanaAdvances.
+	verdanaUnitsPerEm = 2048.0
+	// verdanaDefaultAdvance is used for characters missing from verdanaAdvances, like arrows and math symbols.
+	verdanaDefaultAdvance = 1676
+)
+
+// verdanaAdvances holds the advance widths of the printable ASCII characters in Verdana.
+var verdanaAdvances = map[rune]int{
+	' ': 720, '!': 809, '"': 943, '#': 1676, '$': 1302, '%': 2200, '&': 1464, '\'': 550,
+	'(': 1038, ')': 1038, '*': 1302, '+': 1676, ',': 745, '-': 878, '.': 745, '/': 1075,
+	'0': 1302, '1': 1302, '2': 1302, '3': 1302, '4': 1302, '5': 1302, '6': 1302, '7': 1302, '8': 1302, '9': 1302,
+	':': 889, ';': 889, '<': 1676, '=': 1676, '>': 1676, '?': 1116, '@': 2048,
+	'A': 1401, 'B': 1411, 'C': 1432, 'D': 1588, 'E': 1292, 'F': 1178, 'G': 1581, 'H': 1546, 'I': 866,
+	'J': 921, 'K': 1424, 'L': 1141, 'M': 1726, 'N': 1532, 'O': 1612, 'P': 1239, 'Q': 1612, 'R': 1431,
+	'S': 1401, 'T': 1250, 'U': 1510, 'V': 1401, 'W': 2025, 'X': 1403, 'Y': 1250, 'Z': 1403,
+	'[': 1038, '\\': 1075, ']': 1038, '^': 1676, '_': 1302, '`': 1302,
+	'a': 1233, 'b': 1276, 'c': 1067, 'd': 1276, 'e': 1220, 'f': 720, 'g': 1276, 'h': 1296, 'i': 562,
+	'j': 615, 'k': 1186, 'l': 562, 'm': 1992, 'n': 1296, 'o': 1243, 'p': 1276, 'q': 1276, 'r': 874,
+	's': 1067, 't': 807, 'u': 1296, 'v': 1186, 'w': 1675, 'x': 1186, 'y': 1186, 'z': 1055,
+	'{': 1300, '|': 1038, '}': 1300, '~': 1676,
+}
+
+type badge struct {
+	Label   string
+	Message string
+	Color   string
+}
+
+// textWidth returns the rendered width of the text in pixels, measured in Verdana at the badge font size.
+func textWidth(text string) float64 {
+	units := 0
+	for _, r := range text {
+		advance, ok := verdanaAdvances[r]
+		if !ok {
+			advance = verdanaDefaultAdvance
+		}
+		units += advance
+	}
+	return float64(units) * badgeFontSize / verdanaUnitsPerEm
+}
+
+// renderBadge draws a shields.io flat style badge, text coordinates are in tenth of pixels as the text is scaled by .1
+func renderBadge(b badge) []byte {
+	labelTextWidth := int(math.Ceil(textWidth(b.Label)))
+	messageTextWidth := int(math.Ceil(textWidth(b.Message)))
+
+	labelWidth := labelTextWidth + 10
+	messageWidth := messageTextWidth + 10
+	width := labelWidth + messageWidth
+
+	label := html.EscapeString(b.Label)
+	message := html.EscapeString(b.Message)
+
+	svg := fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20" role="img" aria-label="%s: %s">`, width, label, message)
+	svg += fmt.Sprintf(`<title>%s: %s</title>`, label, message)
+	svg += `<linearGradient id="b" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`
+	svg += fmt.Sprintf(`<clipPath id="a"><rect width="%d" height="20" rx="3" fill="#fff"/></clipPath>`, width)
+	svg += `<g clip-path="url(#a)">`
+	svg += fmt.Sprintf(`<path fill="#555" d="M0 0h%dv20H0z"/>`, labelWidth)
+	svg += fmt.Sprintf(`<path fill="%s" d="M%d 0h%dv20H%dz"/>`, html.EscapeString(b.Color), labelWidth, messageWidth, labelWidth)
+	svg += fmt.Sprintf(`<path fill="url(#b)" d="M0 0h%dv20H0z"/>`, width)
+	svg += `</g>`
+	svg += `<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" text-rendering="geometricPrecision" font-size="110">`
+	svg += badgeText(label, labelWidth*5, labelTextWidth*10)
+	svg += badgeText(message, labelWidth*10+messageWidth*5, messageTextWidth*10)
+	svg += `</g></svg>`
+
+	return []byte(svg)
+}
+
+func badgeText(text string, x, length int) string {
+	shadow := fmt.Sprintf(`<text aria-hidden="true" x="%d" y="150" fill="#010101" fill-opacity=".3" transform="scale(.1)" textLength="%d">%s</text>`, x, length, text)
+	return shadow + fmt.Sprintf(`<text x="%d" y="140" transform="scale(.1)" textLength="%d">%s</text>`, x, length, text)
+}
+
+// respondWithBadge writes the badge with an ETag of its content, a matching If-None-Match gets a 304,
+// a zero maxAge makes clients revalidate on every load.
+func respondWithBadge(b badge, maxAge time.Duration, w http.ResponseWriter, r *http.Request) error {
+	svg := renderBadge(b)
+	etag := fmt.Sprintf(`"%x"`, sha1.Sum(svg))
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("ETag", etag)
+	if maxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	_, err := w.Write(svg)
+	return err
+}
+
+func errorBadge() badge {
+	return badge{Label: badgeLabel, Message: "error", Color: colorError}
+}
+
+// rateLimitedBadge tells that the check could not run, as opposed to errorBadge it is not the PR's fault.
+func rateLimitedBadge() badge {
+	return badge{Label: badgeLabel, Message: "rate limited, retry later", Color: colorWarning}
+}
+
+// badgeForResults combines the results into a single badge, a single failing step gets its own failure message.
+func badgeForResults(results []stepResult) badge {
+	var failed []stepResult
+	for _, result := range results {
+		if len(result.Failures) > 0 {
+			failed = append(failed, result)
+		}
+	}
+
+	switch {
+	case len(failed) == 0:
+		return badge{Label: badgeLabel, Message: "✔", Color: colorOk}
+	case len(failed) == 1 && len(results) == 1:
+		return badge{Label: badgeLabel, Message: failed[0].Failures[0].Short, Color: colorError}
+	case len(failed) == 1:
+		return badge{Label: badgeLabel, Message: failed[0].Step.ID + ": " + failed[0].Failures[0].Short, Color: colorError}
+	default:
+		return badge{Label: badgeLabel, Message: fmt.Sprintf("%d of %d steps failed", len(failed), len(results)), Color: colorError}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"container/list"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultCacheSize = 1000
+
+// shaPattern matches full commit or object SHAs in the path or the ref of a URL, resources addressed by SHA never change.
+var shaPattern = regexp.MustCompile(`(/|ref=)[0-9a-f]{40}(/|&|$)`)
+
+type cacheEntry struct {
+	key          string
+	etag         string
+	lastModified string
+	body         []byte
+	expires      time.Time
+}
+
+func (e cacheEntry) fresh(now time.Time) bool {
+	return now.Before(e.expires)
+}
+
+// responseCache is a bounded LRU of GitHub responses, stale entries are kept to revalidate them with conditional requests.
+type responseCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+func newResponseCache(capacity int) *responseCache {
+	return &responseCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+func (c *responseCache) get(key string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+
+	c.order.MoveToFront(element)
+	return element.Value.(cacheEntry), true
+}
+
+func (c *responseCache) add(entry cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[entry.key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[entry.key] = c.order.PushFront(entry)
+
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(cacheEntry).key)
+	}
+}
+
+// cacheTTL tells how long a response can be served without revalidating it.
+func cacheTTL(url string) time.Duration {
+	switch {
+	case shaPattern.MatchString(url):
+		// files at a commit and git objects
+		return 24 * time.Hour
+	case strings.Contains(url, "/pulls/") && strings.Contains(url, "/files?"):
+		return time.Minute
+	case strings.Contains(url, "/git/refs/tags/"), strings.Contains(url, "/releases/"):
+		return 5 * time.Minute
+	case strings.Contains(url, "/contents/"):
+		return 5 * time.Minute
+	default:
+		return time.Minute
+	}
+}
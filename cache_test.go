@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newResponseCache(2)
+	c.add(cacheEntry{key: "a", body: []byte("a")})
+	c.add(cacheEntry{key: "b", body: []byte("b")})
+
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("a is missing")
+	}
+	c.add(cacheEntry{key: "c", body: []byte("c")})
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.get(key); ok != want {
+			t.Errorf("%s cached = %v, want %v", key, ok, want)
+		}
+	}
+
+	c.add(cacheEntry{key: "a", body: []byte("a2")})
+	if entry, _ := c.get("a"); string(entry.body) != "a2" {
+		t.Errorf("a = %q, want the updated entry", entry.body)
+	}
+	if c.order.Len() != 2 || len(c.entries) != 2 {
+		t.Errorf("cache holds %d/%d entries, want 2", c.order.Len(), len(c.entries))
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	repo := "https://api.github.com/repos/bitrise-io/bitrise-steplib"
+	for url, want := range map[string]time.Duration{
+		"https://github.com/bitrise-io/bitrise-steplib/raw/0123456789abcdef0123456789abcdef01234567/steps/script/1.0.0/step.yml": 24 * time.Hour,
+		repo + "/contents/steps/script/1.0.0/step.yml?ref=0123456789abcdef0123456789abcdef01234567":                              24 * time.Hour,
+		"https://api.github.com/repos/bitrise-steplib/steps-script/git/tags/0123456789abcdef0123456789abcdef01234567":            24 * time.Hour,
+		repo + "/pulls/1/files?page=1&per_page=100":                                                                              time.Minute,
+		repo + "/pulls/1": time.Minute,
+		"https://api.github.com/repos/bitrise-steplib/steps-script/git/refs/tags/1.0.0": 5 * time.Minute,
+		"https://api.github.com/repos/bitrise-steplib/steps-script/releases/tags/1.0.0": 5 * time.Minute,
+		repo + "/contents/steps/script": 5 * time.Minute,
+	} {
+		if got := cacheTTL(url); got != want {
+			t.Errorf("cacheTTL(%s) = %s, want %s", url, got, want)
+		}
+	}
+}
+
+// etagServer serves the current body with its ETag, and answers 304 to requests which already have it.
+type etagServer struct {
+	mu          sync.Mutex
+	version     int
+	requests    int
+	conditional []string
+}
+
+func (s *etagServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	s.conditional = append(s.conditional, r.Header.Get("If-None-Match")+"|"+r.Header.Get("If-Modified-Since"))
+
+	etag := fmt.Sprintf(`"v%d"`, s.version)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if _, err := fmt.Fprintf(w, "body v%d", s.version); err != nil {
+		panic(err)
+	}
+}
+
+func expire(c *githubClient, url string) {
+	entry, _ := c.cache.get(url)
+	entry.expires = time.Now().Add(-time.Second)
+	c.cache.add(entry)
+}
+
+func TestGithubClientRevalidatesStaleResponses(t *testing.T) {
+	upstream := &etagServer{version: 1}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+	c := newGithubClient(basicAuth{})
+
+	get := func(want string) {
+		t.Helper()
+		body, found, err := c.get(server.URL)
+		if err != nil || !found || string(body) != want {
+			t.Fatalf("get = %q, %v, %v, want %q", body, found, err, want)
+		}
+	}
+
+	get("body v1")
+	get("body v1")
+	if upstream.requests != 1 {
+		t.Fatalf("fresh response requested again, %d requests", upstream.requests)
+	}
+
+	expire(c, server.URL)
+	get("body v1")
+	if upstream.requests != 2 || upstream.conditional[1] != `"v1"|Mon, 02 Jan 2006 15:04:05 GMT` {
+		t.Fatalf("revalidation = %q", upstream.conditional)
+	}
+	if entry, _ := c.cache.get(server.URL); !entry.fresh(time.Now()) {
+		t.Error("entry is not fresh after the 304")
+	}
+
+	upstream.version = 2
+	expire(c, server.URL)
+	get("body v2")
+	get("body v2")
+	if upstream.requests != 3 {
+		t.Errorf("%d requests, want 3", upstream.requests)
+	}
+}
+
+func TestGithubClientDoesNotCacheMissingResources(t *testing.T) {
+	server, requests := githubTestServer(t, respond(http.StatusNotFound, nil))
+	defer server.Close()
+	c := newGithubClient(basicAuth{})
+
+	for i := 0; i < 2; i++ {
+		if _, found, err := c.get(server.URL); err != nil || found {
+			t.Fatalf("get = %v, %v, want not found", found, err)
+		}
+	}
+	if n := requests.count(); n != 2 {
+		t.Errorf("%d requests, want 2", n)
+	}
+}
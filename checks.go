@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	checkRunName = "Tag check"
+
+	failureTagNotFound       = "tag-not-found"
+	failureTagCommitMismatch = "tag-commit-mismatch"
+	failureTagNotCommit      = "tag-not-commit"
+)
+
+type checkFailure struct {
+	Code    string `json:"code"`
+	Title   string `json:"title"`
+	Message string `json:"message"`
+	Short   string `json:"short"`
+	Line    int    `json:"line"`
+}
+
+type checkRunAnnotation struct {
+	Path            string `json:"path"`
+	StartLine       int    `json:"start_line"`
+	EndLine         int    `json:"end_line"`
+	AnnotationLevel string `json:"annotation_level"`
+	Title           string `json:"title"`
+	Message         string `json:"message"`
+}
+
+type checkRunOutput struct {
+	Title       string               `json:"title"`
+	Summary     string               `json:"summary"`
+	Annotations []checkRunAnnotation `json:"annotations,omitempty"`
+}
+
+type checkRun struct {
+	Name        string         `json:"name"`
+	HeadSHA     string         `json:"head_sha"`
+	Status      string         `json:"status"`
+	Conclusion  string         `json:"conclusion"`
+	CompletedAt string         `json:"completed_at"`
+	Output      checkRunOutput `json:"output"`
+}
+
+type commitStatus struct {
+	State       string `json:"state"`
+	Description string `json:"description"`
+	Context     string `json:"context"`
+}
+
+// newCommitStatus sums up the check run for the commit statuses API, which has no room for the details.
+func newCommitStatus(run checkRun) commitStatus {
+	status := commitStatus{State: "success", Description: run.Output.Title, Context: checkRunName}
+	if run.Conclusion != "success" {
+		status.State = "failure"
+	}
+	if len(status.Description) > 140 {
+		status.Description = status.Description[:137] + "..."
+	}
+	return status
+}
+
+// validateStep runs the tag checks on the step, the returned error is set only if the checks could not be completed.
+func validateStep(lib *steplib, step stepFile) (stepResult, error) {
+	result := stepResult{Step: step}
+
+	version, err := semverPolicyFromEnv().validate(step.Version)
+	if err != nil {
+		semverErr, ok := err.(semverError)
+		if !ok {
+			return stepResult{}, err
+		}
+
+		result.Failures = append(result.Failures, checkFailure{
+			Code:    semverErr.Code,
+			Title:   "Invalid semver",
+			Message: semverErr.Error(),
+			Short:   semverErr.Short(),
+			Line:    1,
+		})
+		return result, nil
+	}
+
+	failures, warnings, err := checkVersionOrdering(lib, step, version)
+	if err != nil {
+		return stepResult{}, err
+	}
+	result.Failures = append(result.Failures, failures...)
+	result.Warnings = append(result.Warnings, warnings...)
+
+	target, found, err := lib.github.tag(step.Step.Source.Git, step.Version)
+	if err != nil {
+		return stepResult{}, err
+	}
+
+	if !found {
+		result.Failures = append(result.Failures, checkFailure{
+			Code:    failureTagNotFound,
+			Title:   "Tag missing",
+			Message: fmt.Sprintf("tag %s does not exist in %s", step.Version, step.Step.Source.Git),
+			Short:   fmt.Sprintf("tag %s missing", step.Version),
+			Line:    findYMLLine(step.Raw, "git"),
+		})
+		return result, nil
+	}
+	result.Tag = &target
+
+	if target.Type != "commit" {
+		result.Failures = append(result.Failures, checkFailure{
+			Code:    failureTagNotCommit,
+			Title:   "Tag does not point at a commit",
+			Message: fmt.Sprintf("tag %s points at %s, not at a commit", step.Version, target),
+			Short:   fmt.Sprintf("tag %s → %s", step.Version, target.Type),
+			Line:    findYMLLine(step.Raw, "commit"),
+		})
+		return result, nil
+	}
+
+	if target.SHA != step.Step.Source.Commit {
+		result.Failures = append(result.Failures, checkFailure{
+			Code:    failureTagCommitMismatch,
+			Title:   "Tag points at another commit",
+			Message: fmt.Sprintf("tag %s points at %s, but source.commit is %s", step.Version, target, step.Step.Source.Commit),
+			Short:   fmt.Sprintf("tag %s → %s ≠ %s", step.Version, shortSHA(target.SHA), shortSHA(step.Step.Source.Commit)),
+			Line:    findYMLLine(step.Raw, "commit"),
+		})
+	}
+
+	return result, nil
+}
+
+// findYMLLine returns the 1 based line number of the first key: value line, or 1 if the key is not present.
+func findYMLLine(raw []byte, key string) int {
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for line := 1; scanner.Scan(); line++ {
+		if strings.HasPrefix(strings.TrimSpace(scanner.Text()), key+":") {
+			return line
+		}
+	}
+	return 1
+}
+
+type stepResult struct {
+	Step     stepFile
+	Tag      *tagTarget
+	Failures []checkFailure
+	Warnings []checkFailure
+}
+
+// checkPR validates every step.yml changed by the PR at the head commit.
+func checkPR(lib *steplib, pr int, headSHA string) ([]stepResult, error) {
+	steps, err := parseSteps(lib, pr, headSHA)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []stepResult
+	for _, step := range steps {
+		result, err := validateStep(lib, step)
+		if isRateLimitError(err) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to validate %s: %s", step.Path, err)
+		}
+
+		logger.with("repo", lib.fullName()).with("pr", pr).forStep(step.ID, step.Version).
+			with("failures", len(result.Failures)).with("warnings", len(result.Warnings)).debugf("step validated")
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
+
+func newCheckRun(headSHA string, results []stepResult) checkRun {
+	run := checkRun{
+		Name:        checkRunName,
+		HeadSHA:     headSHA,
+		Status:      "completed",
+		Conclusion:  "success",
+		CompletedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	failed := 0
+	summary := ""
+	for _, result := range results {
+		step := result.Step
+
+		summary += fmt.Sprintf("### %s %s\n", step.ID, step.Version)
+		if len(result.Failures) == 0 {
+			summary += fmt.Sprintf("Tag %s exists in %s and points at %s.\n", step.Version, step.Step.Source.Git, result.Tag)
+		} else {
+			failed++
+		}
+
+		for _, issue := range []struct {
+			level  string
+			issues []checkFailure
+		}{{"failure", result.Failures}, {"warning", result.Warnings}} {
+			for _, failure := range issue.issues {
+				summary += fmt.Sprintf("- %s **%s**: %s\n", issue.level, failure.Title, failure.Message)
+
+				run.Output.Annotations = append(run.Output.Annotations, checkRunAnnotation{
+					Path:            step.Path,
+					StartLine:       failure.Line,
+					EndLine:         failure.Line,
+					AnnotationLevel: issue.level,
+					Title:           failure.Title,
+					Message:         failure.Message,
+				})
+			}
+		}
+		summary += "\n"
+	}
+	run.Output.Summary = summary
+
+	if failed == 0 {
+		run.Output.Title = fmt.Sprintf("Tag check passed for %d step(s)", len(results))
+		return run
+	}
+
+	run.Conclusion = "failure"
+	run.Output.Title = fmt.Sprintf("Tag check failed for %d of %d step(s)", failed, len(results))
+
+	return run
+}
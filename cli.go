@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+)
+
+const (
+	failureSourceInvalid = "source-invalid"
+	failureAudit         = "audit-failed"
+
+	// exit codes of the check command
+	exitPassed = 0
+	exitFailed = 1
+	exitError  = 2
+)
+
+// localCheck is the output of the check command, in the same shape as the check API.
+type localCheck struct {
+	Range string `json:"range"`
+	apiCheck
+}
+
+// runCheck is the check subcommand, it validates the step.yml files changed in a local steplib checkout:
+//
+//	steplib-git-check check [-steplib <path>] [-range <base>..<head>] [-format text|json]
+func runCheck(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dir := flags.String("steplib", ".", "path of the local steplib checkout")
+	diffRange := flags.String("range", "origin/master...HEAD", "git diff range of the changes: <base>..<head>, <base>...<head> or <base> to compare with the working tree")
+	format := flags.String("format", "text", "output format: text or json")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	if *format != "text" && *format != "json" {
+		fmt.Fprintln(stderr, "invalid format:", *format)
+		return exitError
+	}
+
+	// the logs must not mix with the results
+	logger = newLoggerFromEnv(stderr)
+
+	steplibs, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(stderr, "invalid config:", err)
+		return exitError
+	}
+	lib := *steplibs.defaultLib
+
+	local, err := newLocalSteplib(*dir, *diffRange, lib.github)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	lib.github = local
+
+	results, err := checkLocalSteps(&lib)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+
+	check := localCheck{Range: *diffRange, apiCheck: newAPICheck(0, results)}
+	if *format == "json" {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(check); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+	} else {
+		printCheck(stdout, check)
+	}
+
+	if !check.Passed {
+		return exitFailed
+	}
+	return exitPassed
+}
+
+// checkLocalSteps runs the checks of the server on the changed step.yml files, and audits them as the steplib CI does.
+func checkLocalSteps(lib *steplib) ([]stepResult, error) {
+	steps, err := changedSteps(lib, 0, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var results []stepResult
+	for _, step := range steps {
+		if step.Step.Source == nil || step.Step.Source.Git == "" || step.Step.Source.Commit == "" {
+			results = append(results, stepResult{Step: step, Failures: []checkFailure{{
+				Code:    failureSourceInvalid,
+				Title:   "Source missing",
+				Message: "source.git and source.commit have to be set",
+				Short:   "source missing",
+				Line:    findYMLLine(step.Raw, "source"),
+			}}})
+			continue
+		}
+
+		result, err := validateStep(lib, step)
+		if err != nil {
+			return nil, fmt.Errorf("failed to validate %s: %s", step.Path, err)
+		}
+
+		// the published_at is set by the steplib on share, it is not there yet
+		if err := step.Step.AuditBeforeShare(); err != nil {
+			result.Failures = append(result.Failures, checkFailure{
+				Code:    failureAudit,
+				Title:   "Audit failed",
+				Message: err.Error(),
+				Short:   "audit failed",
+				Line:    1,
+			})
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func printCheck(w io.Writer, check localCheck) {
+	for _, step := range check.Steps {
+		verdict := "PASS"
+		if !step.Passed {
+			verdict = "FAIL"
+		}
+		fmt.Fprintf(w, "%s %s %s (%s)\n", verdict, step.StepID, step.Version, step.Path)
+
+		for _, failure := range step.Failures {
+			fmt.Fprintf(w, "  error   [%s] %s: %s\n", failure.Code, failure.Title, failure.Message)
+		}
+		for _, warning := range step.Warnings {
+			fmt.Fprintf(w, "  warning [%s] %s: %s\n", warning.Code, warning.Title, warning.Message)
+		}
+	}
+
+	passed := 0
+	for _, step := range check.Steps {
+		if step.Passed {
+			passed++
+		}
+	}
+	fmt.Fprintf(w, "%d of %d step(s) passed in %s\n", passed, len(check.Steps), check.Range)
+}
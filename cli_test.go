@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newLocalSteplibRepo creates a steplib checkout on master with steps/script/1.0.0 and the branches:
+// feature adds steps/script/1.1.0 while master adds steps/other/1.0.0, renamed moves 1.0.0 to 1.1.0,
+// removed deletes steps/script/1.0.0, missing-tag adds 3.0.0 without a tag and no-source adds 1.1.0 without a source.
+func newLocalSteplibRepo(t *testing.T) string {
+	root := gitTestEnv(t)
+	setConfig(t, "", nil)
+	// runCheck logs to its stderr
+	defaultLogger := logger
+	t.Cleanup(func() { logger = defaultLogger })
+	giturl, commit := newSourceRepo(t, root)
+
+	dir := filepath.Join(root, "steplib")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	git(t, dir, "init", "--quiet")
+	git(t, dir, "checkout", "--quiet", "-b", "master")
+	writeStepYML(t, dir, "steps/script/1.0.0", giturl, commit)
+	commitAll(t, dir, "script 1.0.0")
+
+	git(t, dir, "checkout", "--quiet", "-b", "feature")
+	writeStepYML(t, dir, "steps/script/1.1.0", giturl, commit)
+	commitAll(t, dir, "script 1.1.0")
+
+	git(t, dir, "checkout", "--quiet", "-b", "renamed", "master")
+	git(t, dir, "mv", "steps/script/1.0.0", "steps/script/1.1.0")
+	commitAll(t, dir, "rename script 1.0.0")
+
+	git(t, dir, "checkout", "--quiet", "-b", "removed", "master")
+	git(t, dir, "rm", "--quiet", "-r", "steps/script/1.0.0")
+	commitAll(t, dir, "remove script 1.0.0")
+
+	git(t, dir, "checkout", "--quiet", "-b", "missing-tag", "master")
+	writeStepYML(t, dir, "steps/script/3.0.0", giturl, commit)
+	commitAll(t, dir, "script 3.0.0")
+
+	git(t, dir, "checkout", "--quiet", "-b", "no-source", "master")
+	writeStepYML(t, dir, "steps/script/1.1.0", "", "")
+	commitAll(t, dir, "script 1.1.0 without source")
+
+	git(t, dir, "checkout", "--quiet", "master")
+	// not similar enough to script to be diffed as a rename of it
+	pth := filepath.Join(dir, "steps/other/1.0.0/step.yml")
+	if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+		t.Fatal(err)
+	}
+	other := "title: Other step of a different maintainer\nsummary: Does something else entirely\nwebsite: https://other.example.org/steps/other\n" +
+		"description: |-\n  Its description is long enough to make the diff of the two steps differ.\n"
+	if err := ioutil.WriteFile(pth, []byte(other), 0644); err != nil {
+		t.Fatal(err)
+	}
+	commitAll(t, dir, "other 1.0.0")
+
+	return dir
+}
+
+func writeStepYML(t *testing.T, dir, versionDir, giturl, commit string) {
+	yml := "title: Script\nsummary: Runs a script\nwebsite: https://example.com\n"
+	if giturl != "" {
+		yml += "source:\n  git: " + giturl + "\n  commit: " + commit + "\n"
+	}
+
+	pth := filepath.Join(dir, versionDir, "step.yml")
+	if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pth, []byte(yml), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func commitAll(t *testing.T, dir, message string) {
+	git(t, dir, "add", "-A")
+	git(t, dir, "commit", "--quiet", "-m", message)
+}
+
+func TestLocalSteplibFiles(t *testing.T) {
+	dir := newLocalSteplibRepo(t)
+
+	for _, tc := range []struct {
+		diffRange string
+		want      []file
+	}{
+		{"master..feature", []file{{Filename: "steps/other/1.0.0/step.yml", Status: "removed"}, {Filename: "steps/script/1.1.0/step.yml", Status: "added"}}},
+		{"master...feature", []file{{Filename: "steps/script/1.1.0/step.yml", Status: "added"}}},
+		{"...feature", []file{{Filename: "steps/script/1.1.0/step.yml", Status: "added"}}},
+		{"master...renamed", []file{{Filename: "steps/script/1.1.0/step.yml", Status: "renamed"}}},
+		{"master...removed", []file{{Filename: "steps/script/1.0.0/step.yml", Status: "removed"}}},
+		{"master", nil},
+	} {
+		t.Run(tc.diffRange, func(t *testing.T) {
+			local, err := newLocalSteplib(dir, tc.diffRange, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files, err := local.pullRequestFiles(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(files, tc.want) {
+				t.Errorf("files = %+v, want %+v", files, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunCheck(t *testing.T) {
+	dir := newLocalSteplibRepo(t)
+
+	for _, tc := range []struct {
+		name      string
+		diffRange string
+		code      int
+		version   string
+		failure   string
+	}{
+		{name: "two dot range", diffRange: "master..feature", code: exitPassed, version: "1.1.0"},
+		{name: "three dot range", diffRange: "master...feature", code: exitPassed, version: "1.1.0"},
+		{name: "renamed version", diffRange: "master...renamed", code: exitPassed, version: "1.1.0"},
+		{name: "tag missing", diffRange: "master...missing-tag", code: exitFailed, version: "3.0.0", failure: failureTagNotFound},
+		{name: "source missing", diffRange: "master...no-source", code: exitFailed, version: "1.1.0", failure: failureSourceInvalid},
+		{name: "only removed", diffRange: "master...removed", code: exitError},
+		{name: "no changes", diffRange: "master..master", code: exitError},
+		{name: "unknown revision", diffRange: "master...unknown", code: exitError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := runCheck([]string{"-steplib", dir, "-range", tc.diffRange, "-format", "json"}, &stdout, &stderr)
+			if code != tc.code {
+				t.Fatalf("exit code = %d, want %d, stderr: %s", code, tc.code, stderr.String())
+			}
+			if tc.code == exitError {
+				if stdout.Len() != 0 || stderr.Len() == 0 {
+					t.Errorf("stdout = %q, stderr = %q", stdout.String(), stderr.String())
+				}
+				return
+			}
+
+			var check localCheck
+			if err := json.Unmarshal(stdout.Bytes(), &check); err != nil {
+				t.Fatalf("invalid output %q: %s", stdout.String(), err)
+			}
+			if check.Range != tc.diffRange || check.Passed != (tc.code == exitPassed) || len(check.Steps) != 1 {
+				t.Fatalf("check = %+v", check)
+			}
+
+			step := check.Steps[0]
+			if step.StepID != "script" || step.Version != tc.version {
+				t.Errorf("step = %s %s, want script %s", step.StepID, step.Version, tc.version)
+			}
+			if got := failureCodes(step.Failures); !reflect.DeepEqual(got, codes(tc.failure)) {
+				t.Errorf("failures = %v, want %v", got, codes(tc.failure))
+			}
+		})
+	}
+}
+
+func TestRunCheckWorkingTree(t *testing.T) {
+	dir := newLocalSteplibRepo(t)
+	giturl := "file://" + filepath.Join(filepath.Dir(dir), "source")
+	writeStepYML(t, dir, "steps/script/1.1.0", giturl, git(t, filepath.Join(filepath.Dir(dir), "source"), "rev-parse", "HEAD"))
+	git(t, dir, "add", "steps/script/1.1.0/step.yml")
+	// unstaged changes are checked too
+	writeStepYML(t, dir, "steps/other/1.0.0", "", "")
+
+	var stdout, stderr bytes.Buffer
+	code := runCheck([]string{"-steplib", dir, "-range", "HEAD"}, &stdout, &stderr)
+	if code != exitFailed {
+		t.Fatalf("exit code = %d, want %d, stderr: %s", code, exitFailed, stderr.String())
+	}
+
+	want := "FAIL other 1.0.0 (steps/other/1.0.0/step.yml)\n" +
+		"  error   [" + failureSourceInvalid + "] Source missing: source.git and source.commit have to be set\n" +
+		"PASS script 1.1.0 (steps/script/1.1.0/step.yml)\n" +
+		"1 of 2 step(s) passed in HEAD\n"
+	if stdout.String() != want {
+		t.Errorf("output = %q, want %q", stdout.String(), want)
+	}
+}
+
+func TestRunCheckInvalidArgs(t *testing.T) {
+	dir := newLocalSteplibRepo(t)
+
+	for name, args := range map[string][]string{
+		"unknown flag":   {"-unknown"},
+		"invalid format": {"-steplib", dir, "-range", "master...feature", "-format", "xml"},
+		"not a checkout": {"-steplib", t.TempDir(), "-range", "master...feature"},
+	} {
+		var stdout, stderr bytes.Buffer
+		if code := runCheck(args, &stdout, &stderr); code != exitError {
+			t.Errorf("%s: exit code = %d, want %d", name, code, exitError)
+		}
+		if stdout.Len() != 0 || stderr.Len() == 0 {
+			t.Errorf("%s: stdout = %q, stderr = %q", name, stdout.String(), stderr.String())
+		}
+	}
+}
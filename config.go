@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const defaultNewStepTemplate = "**New Step**\r\nThank you for the new Step share! The CI check might will fail due to our extended validation engine. Nothing to worry about yet, we will get back to you shortly."
+
+// prTemplates are the texts the bot adds to the PR bodies.
+type prTemplates struct {
+	BadgeTitle string `yaml:"badge_title"`
+	NewStep    string `yaml:"new_step"`
+}
+
+// steplib is the configuration of a steplib repository the service checks the PRs of.
+type steplib struct {
+	Owner string `yaml:"owner"`
+	Repo  string `yaml:"repo"`
+	// BaseURL is the public URL of this service, the badge links in the PR bodies point to it.
+	BaseURL     string `yaml:"base_url"`
+	StepsPrefix string `yaml:"steps_prefix"`
+	// OfficialOrgs are the GitHub organizations of the steps which get release links and Discourse announcements.
+	OfficialOrgs []string `yaml:"official_orgs"`
+	// TagBackend resolves the source tags with the GitHub API (github), with git (git) or picks by host (auto).
+	TagBackend string            `yaml:"tag_backend"`
+	GitHub     githubCredentials `yaml:"github"`
+	Discourse  discourseConfig   `yaml:"discourse"`
+	Templates  prTemplates       `yaml:"templates"`
+
+	// Default is the steplib of the requests which do not name a repository, the first configured one.
+	Default bool          `yaml:"-"`
+	client  *githubClient `yaml:"-"`
+	github  githubAPI     `yaml:"-"`
+}
+
+// configFile either describes a single steplib at the top level, or several ones in steplibs,
+// the top level base_url and steps_prefix are inherited by the steplibs which do not set them.
+type configFile struct {
+	steplib  `yaml:",inline"`
+	Steplibs []steplib `yaml:"steplibs"`
+}
+
+type steplibRegistry struct {
+	byName     map[string]*steplib
+	defaultLib *steplib
+}
+
+func defaultSteplib() steplib {
+	return steplib{
+		Owner:        "bitrise-io",
+		Repo:         "bitrise-steplib",
+		BaseURL:      "https://bitrise-steplib-git-check.herokuapp.com",
+		StepsPrefix:  "steps/",
+		OfficialOrgs: []string{"bitrise-io", "bitrise-steplib", "bitrise-community"},
+		Templates:    prTemplates{BadgeTitle: "TagCheck", NewStep: defaultNewStepTemplate},
+	}
+}
+
+// loadConfig reads the YAML file at CONFIG_PATH if set, the env vars configure the default (first) steplib:
+// STEPLIB_* and the other settings of the single steplib setup override the file,
+// credentials only fill the ones missing from it.
+func loadConfig() (*steplibRegistry, error) {
+	var file configFile
+
+	if pth := os.Getenv("CONFIG_PATH"); pth != "" {
+		b, err := ioutil.ReadFile(pth)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := yaml.UnmarshalStrict(b, &file); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %s", pth, err)
+		}
+	}
+
+	libs := file.Steplibs
+	if len(libs) == 0 {
+		libs = []steplib{file.steplib}
+	}
+
+	defaults := defaultSteplib()
+	if file.BaseURL != "" {
+		defaults.BaseURL = file.BaseURL
+	}
+	if file.StepsPrefix != "" {
+		defaults.StepsPrefix = file.StepsPrefix
+	}
+
+	first := &libs[0]
+	first.Default = true
+	if first.Owner == "" && first.Repo == "" {
+		first.Owner, first.Repo = defaults.Owner, defaults.Repo
+		if first.OfficialOrgs == nil {
+			first.OfficialOrgs = defaults.OfficialOrgs
+		}
+	}
+	applyEnv(first)
+
+	registry := &steplibRegistry{byName: map[string]*steplib{}}
+	for i := range libs {
+		lib := &libs[i]
+
+		if lib.BaseURL == "" {
+			lib.BaseURL = defaults.BaseURL
+		}
+		if lib.StepsPrefix == "" {
+			lib.StepsPrefix = defaults.StepsPrefix
+		}
+		if lib.Templates.BadgeTitle == "" {
+			lib.Templates.BadgeTitle = defaults.Templates.BadgeTitle
+		}
+		if lib.Templates.NewStep == "" {
+			lib.Templates.NewStep = defaults.Templates.NewStep
+		}
+
+		if err := lib.validate(); err != nil {
+			return nil, err
+		}
+
+		name := strings.ToLower(lib.fullName())
+		if _, ok := registry.byName[name]; ok {
+			return nil, fmt.Errorf("steplib %s is configured more than once", lib.fullName())
+		}
+
+		lib.client = newGithubClient(newGithubAuth(lib.GitHub))
+		lib.github = restGithub{client: lib.client, lib: lib}
+		registry.byName[name] = lib
+		if lib.Default {
+			registry.defaultLib = lib
+		}
+	}
+
+	return registry, nil
+}
+
+func applyEnv(lib *steplib) {
+	for env, value := range map[string]*string{
+		"STEPLIB_OWNER":   &lib.Owner,
+		"STEPLIB_REPO":    &lib.Repo,
+		"PUBLIC_BASE_URL": &lib.BaseURL,
+		"STEPS_PREFIX":    &lib.StepsPrefix,
+		"TAG_BACKEND":     &lib.TagBackend,
+	} {
+		if v := os.Getenv(env); v != "" {
+			*value = v
+		}
+	}
+
+	if orgs := os.Getenv("OFFICIAL_SOURCE_ORGS"); orgs != "" {
+		lib.OfficialOrgs = splitList(orgs)
+	}
+
+	lib.GitHub = lib.GitHub.withDefaults(githubCredentialsFromEnv())
+	lib.Discourse = lib.Discourse.withDefaults(discourseConfigFromEnv())
+}
+
+// splitList splits a comma separated env var, dropping the empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// lookup returns the steplib of the owner/repo full name, or the default one if fullName is empty.
+func (r *steplibRegistry) lookup(fullName string) (*steplib, bool) {
+	if fullName == "" {
+		return r.defaultLib, true
+	}
+
+	lib, ok := r.byName[strings.ToLower(fullName)]
+	return lib, ok
+}
+
+func (l *steplib) validate() error {
+	if l.Owner == "" || l.Repo == "" {
+		return fmt.Errorf("steplib owner and repo have to be set")
+	}
+
+	if !strings.HasPrefix(l.BaseURL, "https://") && !strings.HasPrefix(l.BaseURL, "http://") {
+		return fmt.Errorf("base URL %q of %s should start with https:// or http://", l.BaseURL, l.fullName())
+	}
+	l.BaseURL = strings.TrimSuffix(l.BaseURL, "/")
+
+	switch l.TagBackend {
+	case "":
+		l.TagBackend = tagBackendAuto
+	case tagBackendAuto, tagBackendGithub, tagBackendGit:
+	default:
+		return fmt.Errorf("tag backend %q of %s should be %s, %s or %s", l.TagBackend, l.fullName(), tagBackendAuto, tagBackendGithub, tagBackendGit)
+	}
+
+	if !strings.HasSuffix(l.StepsPrefix, "/") {
+		l.StepsPrefix += "/"
+	}
+
+	return nil
+}
+
+func (l *steplib) fullName() string {
+	return l.Owner + "/" + l.Repo
+}
+
+// apiURL returns the GitHub API URL of the steplib repository with the formatted path appended.
+func (l *steplib) apiURL(format string, args ...interface{}) string {
+	return fmt.Sprintf("https://api.github.com/repos/%s/%s", l.Owner, l.Repo) + fmt.Sprintf(format, args...)
+}
+
+// badgeURL links the badge of the PR, only the badges of the default steplib leave out the repository.
+func (l *steplib) badgeURL(pr int) string {
+	if l.Default {
+		return fmt.Sprintf("%s/tag?pr=%d", l.BaseURL, pr)
+	}
+	return fmt.Sprintf("%s/tag?repo=%s&pr=%d", l.BaseURL, l.fullName(), pr)
+}
+
+func (l *steplib) isStepYML(filename string) bool {
+	return strings.HasSuffix(filename, "/step.yml") && strings.HasPrefix(filename, l.StepsPrefix)
+}
+
+// isOfficialSource tells if the step source is a https://github.com/<org>/ repository of an official org.
+// Sources used to match if they contained /<org>/ anywhere, so other hosts and paths like
+// https://example.com/bitrise-io/... passed too, they do not get release links and announcements anymore.
+func (l *steplib) isOfficialSource(giturl string) bool {
+	for _, org := range l.OfficialOrgs {
+		if strings.HasPrefix(giturl, "https://github.com/"+org+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// configEnv are the env vars loadConfig reads, cleared so the environment of the test run does not leak in.
+var configEnv = []string{
+	"CONFIG_PATH", "STEPLIB_OWNER", "STEPLIB_REPO", "PUBLIC_BASE_URL", "STEPS_PREFIX", "TAG_BACKEND", "OFFICIAL_SOURCE_ORGS",
+	"GITHUB_APP_ID", "GITHUB_APP_INSTALLATION_ID", "GITHUB_APP_PRIVATE_KEY", "GITHUB_APP_PRIVATE_KEY_PATH",
+	"GITHUB_USER", "GITHUB_ACCESS_TOKEN", "GITHUB_WEBHOOK_SECRET",
+	"DISCOURSE_URL", "DISCOURSE_API_KEY", "DISCOURSE_API_USERNAME", "DISCOURSE_CATEGORY",
+}
+
+// setConfig clears the config env vars, then writes the config file if given and sets the env vars.
+func setConfig(t *testing.T, config string, env map[string]string) {
+	for _, key := range configEnv {
+		t.Setenv(key, "")
+	}
+
+	if config != "" {
+		pth := filepath.Join(t.TempDir(), "config.yml")
+		if err := ioutil.WriteFile(pth, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("CONFIG_PATH", pth)
+	}
+
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	setConfig(t, "", map[string]string{"GITHUB_USER": "bot", "GITHUB_ACCESS_TOKEN": "token"})
+
+	registry, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lib, ok := registry.lookup("")
+	if !ok || lib.fullName() != "bitrise-io/bitrise-steplib" || !lib.Default {
+		t.Fatalf("default steplib = %+v", lib)
+	}
+	if lib.BaseURL != "https://bitrise-steplib-git-check.herokuapp.com" || lib.StepsPrefix != "steps/" || lib.TagBackend != tagBackendAuto {
+		t.Errorf("steplib = %+v", lib)
+	}
+	if !reflect.DeepEqual(lib.OfficialOrgs, []string{"bitrise-io", "bitrise-steplib", "bitrise-community"}) {
+		t.Errorf("official orgs = %v", lib.OfficialOrgs)
+	}
+	if lib.GitHub.User != "bot" || lib.GitHub.AccessToken != "token" {
+		t.Errorf("credentials are not taken from the env: %+v", lib.GitHub)
+	}
+	if other, ok := registry.lookup("BITRISE-IO/Bitrise-Steplib"); !ok || other != lib {
+		t.Error("lookup is not case insensitive")
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	setConfig(t, `
+base_url: https://check.example.com/
+steplibs:
+- owner: bitrise-io
+  repo: bitrise-steplib
+  official_orgs: [bitrise-io]
+  github:
+    user: file-bot
+    access_token: file-token
+- owner: my-org
+  repo: my-steplib
+  steps_prefix: custom
+  tag_backend: git
+  official_orgs: [my-org]
+  github:
+    user: my-bot
+    access_token: my-token
+  templates:
+    badge_title: MyCheck
+`, map[string]string{
+		"STEPLIB_OWNER":        "fork",
+		"PUBLIC_BASE_URL":      "https://env.example.com",
+		"OFFICIAL_SOURCE_ORGS": "fork, ,bitrise-io",
+		"GITHUB_USER":          "env-bot",
+		"GITHUB_ACCESS_TOKEN":  "env-token",
+	})
+
+	registry, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the env vars override the settings of the first steplib, but only fill its missing credentials
+	first, ok := registry.lookup("fork/bitrise-steplib")
+	if !ok || registry.defaultLib != first {
+		t.Fatalf("the first steplib is not the default one: %v", registry.byName)
+	}
+	if first.BaseURL != "https://env.example.com" {
+		t.Errorf("base URL = %s, want the env override", first.BaseURL)
+	}
+	if !reflect.DeepEqual(first.OfficialOrgs, []string{"fork", "bitrise-io"}) {
+		t.Errorf("official orgs = %v", first.OfficialOrgs)
+	}
+	if first.GitHub.User != "file-bot" || first.GitHub.AccessToken != "file-token" {
+		t.Errorf("credentials of the file are overridden: %+v", first.GitHub)
+	}
+
+	// the other steplibs are not touched by the env vars, they inherit the top level settings
+	second, ok := registry.lookup("my-org/my-steplib")
+	if !ok || second.Default {
+		t.Fatalf("second steplib = %+v", second)
+	}
+	if second.BaseURL != "https://check.example.com" || second.StepsPrefix != "custom/" || second.TagBackend != tagBackendGit {
+		t.Errorf("second steplib = %+v", second)
+	}
+	if second.GitHub.User != "my-bot" || second.Templates.BadgeTitle != "MyCheck" || second.Templates.NewStep != defaultNewStepTemplate {
+		t.Errorf("second steplib = %+v", second)
+	}
+	if second.badgeURL(3) != "https://check.example.com/tag?repo=my-org/my-steplib&pr=3" {
+		t.Errorf("badge URL = %s", second.badgeURL(3))
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config string
+		env    map[string]string
+		err    string
+	}{
+		{"duplicate steplib", "steplibs:\n- owner: my-org\n  repo: steplib\n- owner: My-Org\n  repo: Steplib\n", nil, "configured more than once"},
+		{"env override duplicates a steplib", "steplibs:\n- owner: a\n  repo: steplib\n- owner: b\n  repo: steplib\n", map[string]string{"STEPLIB_OWNER": "b"}, "configured more than once"},
+		{"unknown key", "owner: bitrise-io\nrepository: bitrise-steplib\n", nil, "failed to parse config file"},
+		{"missing repo", "steplibs:\n- owner: bitrise-io\n- owner: my-org\n", nil, "owner and repo have to be set"},
+		{"invalid base URL", "base_url: check.example.com\n", nil, "should start with https://"},
+		{"invalid tag backend", "", map[string]string{"TAG_BACKEND": "svn"}, "tag backend"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setConfig(t, tc.config, tc.env)
+
+			if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("err = %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestIsOfficialSource(t *testing.T) {
+	lib := defaultSteplib()
+	for giturl, want := range map[string]bool{
+		"https://github.com/bitrise-steplib/steps-script.git":      true,
+		"https://github.com/bitrise-io/steps-xcode-test.git":       true,
+		"https://github.com/bitrise-community/steps-slack":         true,
+		"https://github.com/someone/steps-script.git":              false,
+		"https://github.com/bitrise-io-fork/steps-script.git":      false,
+		"https://gitlab.com/bitrise-io/steps-script.git":           false,
+		"https://evil.example/bitrise-io/steps-script.git":         false,
+		"https://evil.example/https://github.com/bitrise-io/steps": false,
+		"git@github.com:bitrise-io/steps-script.git":               false,
+	} {
+		if got := lib.isOfficialSource(giturl); got != want {
+			t.Errorf("isOfficialSource(%s) = %v, want %v", giturl, got, want)
+		}
+	}
+}
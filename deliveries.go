@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	deliveryQueued = "queued"
+	deliveryDone   = "done"
+	deliveryFailed = "failed"
+
+	// maxDeliveryLog keeps the latest entries of the processing log of a delivery
+	maxDeliveryLog = 50
+	// maxStoredDeliveries and deliveryRetention bound the delivery records, older ones are pruned with their body edits
+	maxStoredDeliveries = 1000
+	deliveryRetention   = 30 * 24 * time.Hour
+	// maxStoredPayloads keeps the payloads of the deliveries listed by default on /admin/deliveries
+	maxStoredPayloads = defaultDeliveriesLimit
+	// deliveryPruneInterval is how often the deliveries are pruned, pruning goes through every stored one
+	deliveryPruneInterval = 10 * time.Minute
+)
+
+// redactedKeys are the payload fields which are never recorded, matched case insensitively as substrings.
+var redactedKeys = []string{"token", "secret", "password", "email", "key"}
+
+// deliveryRecord is what the bot knows about a webhook delivery, keyed by X-GitHub-Delivery.
+type deliveryRecord struct {
+	ID          string             `json:"id"`
+	Repo        string             `json:"repo"`
+	PR          int                `json:"pr"`
+	Action      string             `json:"action"`
+	Status      string             `json:"status"`
+	ReceivedAt  time.Time          `json:"received_at"`
+	ProcessedAt time.Time          `json:"processed_at,omitempty"`
+	ReplayOf    string             `json:"replay_of,omitempty"`
+	Log         []deliveryLogEntry `json:"log,omitempty"`
+}
+
+type deliveryLogEntry struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// announcement records the Discourse topic posted about a step version.
+type announcement struct {
+	Repo     string    `json:"repo"`
+	PR       int       `json:"pr"`
+	Title    string    `json:"title"`
+	PostedAt time.Time `json:"posted_at"`
+}
+
+func newDeliveryRecord(id string, lib *steplib, pr pullRequestModel) deliveryRecord {
+	return deliveryRecord{
+		ID:         id,
+		Repo:       lib.fullName(),
+		PR:         pr.Number,
+		Action:     pr.Action,
+		Status:     deliveryQueued,
+		ReceivedAt: time.Now(),
+		Log:        []deliveryLogEntry{{Time: time.Now(), Message: "received " + pr.Action + " event"}},
+	}
+}
+
+// claimDelivery records the delivery as queued, it returns false if the delivery was already queued or processed,
+// GitHub redelivers events it did not get an answer for in time. Failed deliveries can be claimed again.
+func claimDelivery(id string, lib *steplib, pr pullRequestModel) (bool, error) {
+	if id == "" {
+		return true, nil
+	}
+
+	record := newDeliveryRecord(id, lib, pr)
+
+	stored, err := db.putIfAbsent(bucketDeliveries, id, record)
+	if err != nil || stored {
+		return stored, err
+	}
+
+	var existing deliveryRecord
+	if _, err := db.get(bucketDeliveries, id, &existing); err != nil {
+		return false, err
+	}
+	if existing.Status != deliveryFailed {
+		return false, nil
+	}
+
+	record.Log = append(existing.Log, record.Log...)
+	return true, db.put(bucketDeliveries, id, record)
+}
+
+// updateDelivery applies fn to the stored record of the delivery, it is a no-op for unknown deliveries.
+func updateDelivery(id string, fn func(record *deliveryRecord)) {
+	if id == "" {
+		return
+	}
+
+	var record deliveryRecord
+	found, err := db.get(bucketDeliveries, id, &record)
+	if err != nil || !found {
+		logger.with("delivery", id).withError(err).errorf("failed to load delivery")
+		return
+	}
+
+	fn(&record)
+	if len(record.Log) > maxDeliveryLog {
+		record.Log = record.Log[len(record.Log)-maxDeliveryLog:]
+	}
+
+	if err := db.put(bucketDeliveries, id, record); err != nil {
+		logger.with("delivery", id).withError(err).errorf("failed to record delivery")
+	}
+}
+
+// logDelivery appends a line to the processing log of the delivery.
+func logDelivery(id string, format string, args ...interface{}) {
+	updateDelivery(id, func(record *deliveryRecord) {
+		record.Log = append(record.Log, deliveryLogEntry{Time: time.Now(), Message: fmt.Sprintf(format, args...)})
+	})
+}
+
+func finishDelivery(id, status string) {
+	updateDelivery(id, func(record *deliveryRecord) {
+		record.Status = status
+		record.ProcessedAt = time.Now()
+		record.Log = append(record.Log, deliveryLogEntry{Time: record.ProcessedAt, Message: status})
+	})
+}
+
+// failInterruptedDeliveries marks the deliveries left queued by the previous process as failed, their jobs were lost
+// when it crashed or ran out of time draining the queue. Failed deliveries are processed again on a redelivery or replay.
+func failInterruptedDeliveries() (int, error) {
+	values, err := db.list(bucketDeliveries)
+	if err != nil {
+		return 0, err
+	}
+
+	failed := 0
+	for id, raw := range values {
+		var record deliveryRecord
+		if err := json.Unmarshal(raw, &record); err != nil {
+			return failed, err
+		}
+		if record.Status != deliveryQueued {
+			continue
+		}
+
+		updateDelivery(id, func(record *deliveryRecord) {
+			record.Status = deliveryFailed
+			record.ProcessedAt = time.Now()
+			record.Log = append(record.Log, deliveryLogEntry{Time: record.ProcessedAt, Message: "failed: interrupted by a restart"})
+		})
+		failed++
+	}
+	return failed, nil
+}
+
+// recentDeliveries returns the latest deliveries first, without their logs.
+func recentDeliveries(limit int) ([]deliveryRecord, error) {
+	values, err := db.list(bucketDeliveries)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]deliveryRecord, 0, len(values))
+	for _, raw := range values {
+		var record deliveryRecord
+		if err := json.Unmarshal(raw, &record); err != nil {
+			return nil, err
+		}
+		record.Log = nil
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ReceivedAt.After(records[j].ReceivedAt)
+	})
+
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+// recordPayload stores the payload of the delivery with the sensitive fields redacted, so it can be replayed.
+func recordPayload(id string, payload []byte) error {
+	if id == "" {
+		return nil
+	}
+
+	redacted, err := redactPayload(payload)
+	if err != nil {
+		return err
+	}
+	return db.put(bucketPayloads, id, json.RawMessage(redacted))
+}
+
+// pruneDeliveriesPeriodically prunes the deliveries every deliveryPruneInterval, the caps can be exceeded by
+// the deliveries received in between.
+func pruneDeliveriesPeriodically() {
+	ticker := time.NewTicker(deliveryPruneInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if err := pruneDeliveries(now); err != nil {
+			logger.withError(err).errorf("failed to prune deliveries")
+		}
+	}
+}
+
+// pruneDeliveries drops the deliveries received before the retention period or beyond maxStoredDeliveries,
+// and the payloads beyond maxStoredPayloads. Queued deliveries are left alone until they are processed.
+func pruneDeliveries(now time.Time) error {
+	records, err := recentDeliveries(0)
+	if err != nil {
+		return err
+	}
+
+	var expired, payloads []string
+	for i, record := range records {
+		switch {
+		case record.Status == deliveryQueued:
+		case i >= maxStoredDeliveries || now.Sub(record.ReceivedAt) > deliveryRetention:
+			expired = append(expired, record.ID)
+			payloads = append(payloads, record.ID)
+		case i >= maxStoredPayloads:
+			payloads = append(payloads, record.ID)
+		}
+	}
+
+	if err := db.deleteKeys(bucketPayloads, payloads); err != nil {
+		return err
+	}
+	if err := db.deleteKeys(bucketBodyEdits, expired); err != nil {
+		return err
+	}
+	return db.deleteKeys(bucketDeliveries, expired)
+}
+
+func redactPayload(payload []byte) ([]byte, error) {
+	var v interface{}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(redact(v))
+}
+
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if isRedactedKey(key) {
+				v[key] = "[REDACTED]"
+			} else {
+				v[key] = redact(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redact(value)
+		}
+	case string:
+		// a PR body or a commit message can carry a pasted credential too
+		return redactText(v)
+	}
+	return v
+}
+
+func isRedactedKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, redacted := range redactedKeys {
+		if strings.Contains(key, redacted) {
+			return true
+		}
+	}
+	return false
+}
+
+func notificationKey(lib *steplib, pr int) string {
+	return fmt.Sprintf("%s#%d", lib.fullName(), pr)
+}
+
+func announcementKey(lib *steplib, stepID, version string) string {
+	return fmt.Sprintf("%s/%s@%s", lib.fullName(), stepID, version)
+}
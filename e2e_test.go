@@ -0,0 +1,558 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	e2eSecret    = "secret"
+	e2eRepo      = "bitrise-io/bitrise-steplib"
+	e2eSource    = "https://github.com/bitrise-steplib/steps-script.git"
+	e2eCommit    = "c0ffee0000000000000000000000000000000001"
+	e2eNewCommit = "c0ffee0000000000000000000000000000000002"
+)
+
+// e2e drives the webhook and badge handlers of a server whose steplib talks to a fakeGithub over HTTP,
+// the release announcements go to a Discourse test server.
+type e2e struct {
+	t         *testing.T
+	s         *server
+	lib       *steplib
+	github    *fakeGithub
+	discourse *httptest.Server
+
+	mu     sync.Mutex
+	topics []url.Values
+
+	deliveries int
+}
+
+func newE2E(t *testing.T) (*e2e, func()) {
+	previousDB, previousVerdicts := db, verdicts
+	db, verdicts = newMemoryStore(), newVerdictCache()
+
+	e := &e2e{t: t, github: newFakeGithub()}
+	e.discourse = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		e.mu.Lock()
+		e.topics = append(e.topics, r.PostForm)
+		e.mu.Unlock()
+		respondWithJSON(w, http.StatusOK, map[string]int{"id": len(e.topics)})
+	}))
+
+	lib := newFakeSteplib(t, e.github)
+	lib.GitHub.WebhookSecrets = []string{e2eSecret}
+	lib.Discourse = discourseConfig{URL: e.discourse.URL, APIKey: "key", APIUsername: "bitrise-bot", Category: "step-releases"}
+	e.lib = lib
+	e.s = &server{steplibs: &steplibRegistry{byName: map[string]*steplib{e2eRepo: lib}, defaultLib: lib}}
+
+	return e, func() {
+		e.discourse.Close()
+		db, verdicts = previousDB, previousVerdicts
+	}
+}
+
+func stepYML(commit string) string {
+	return fmt.Sprintf("title: Script\nsource:\n  git: %s\n  commit: %s\n", e2eSource, commit)
+}
+
+// addStepPR adds an open PR adding the version of the script step, released with a tag at e2eCommit.
+func (e *e2e) addStepPR(number int, version string, existingVersions ...string) content {
+	pr := content{State: "open", Number: number, Body: "Release " + version}
+	pr.Head.SHA = fmt.Sprintf("head%d", number)
+
+	e.github.addPullRequest(pr, map[string]string{"steps/script/" + version + "/step.yml": stepYML(e2eCommit), "README.md": "readme"})
+	if len(existingVersions) > 0 {
+		e.github.addDir("steps/script", existingVersions...)
+	}
+	e.github.addTag(e2eSource, version, tagTarget{SHA: e2eCommit, Type: "commit"})
+	e.github.addRelease(e2eSource, version, "### Changes\n* Faster")
+	return pr
+}
+
+// currentPR is the PR as GitHub has it now, with the body updates of the bot.
+func (e *e2e) currentPR(number int) content {
+	pr, ok := e.github.currentPullRequest(number)
+	if !ok {
+		e.t.Fatalf("PR %d not found", number)
+	}
+	return pr
+}
+
+// deliver posts the signed webhook event and waits until its job is processed.
+func (e *e2e) deliver(event string, payload interface{}) int {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return e.deliverRaw(event, b, sign(b, e2eSecret))
+}
+
+func (e *e2e) deliverRaw(event string, payload []byte, signature string) int {
+	e.deliveries++
+	return e.redeliver(fmt.Sprintf("delivery-%d", e.deliveries), event, payload, signature)
+}
+
+// redeliver posts the payload with the given delivery ID and waits until its job is processed, like GitHub redelivers.
+func (e *e2e) redeliver(deliveryID, event string, payload []byte, signature string) int {
+	e.s.jobs = newJobQueue(1, 10, runPullRequestJob)
+
+	code := e.post(deliveryID, event, payload, signature)
+
+	if err := e.s.jobs.drain(10 * time.Second); err != nil {
+		e.t.Fatal(err)
+	}
+	if dead := e.s.jobs.deadJobs(); len(dead) > 0 {
+		e.t.Fatalf("jobs failed: %+v", dead)
+	}
+	return code
+}
+
+// post sends the delivery to the webhook handler, without waiting for its job.
+func (e *e2e) post(deliveryID, event string, payload []byte, signature string) int {
+	req := httptest.NewRequest("POST", "/update", strings.NewReader(string(payload)))
+	req.Header.Set("X-Github-Event", event)
+	req.Header.Set("X-Github-Delivery", deliveryID)
+	req.Header.Set("X-Hub-Signature-256", signature)
+	w := httptest.NewRecorder()
+	e.s.updateHandler(w, req)
+	return w.Code
+}
+
+func (e *e2e) pullRequestEvent(action string, pr content) map[string]interface{} {
+	return map[string]interface{}{
+		"action":       action,
+		"number":       pr.Number,
+		"pull_request": pr,
+		"repository":   map[string]string{"full_name": e2eRepo},
+	}
+}
+
+func (e *e2e) badge(number int) string {
+	return e.badgeOf(fmt.Sprintf("pr=%d", number))
+}
+
+// badgeOf requests the badge with the raw query, so invalid ones can be sent too.
+func (e *e2e) badgeOf(query string) string {
+	req := httptest.NewRequest("GET", "/tag?"+query, nil)
+	w := httptest.NewRecorder()
+	e.s.tagHandler(w, req)
+	if ct := w.Header().Get("Content-Type"); ct != "image/svg+xml" {
+		e.t.Fatalf("badge content type = %q", ct)
+	}
+	return w.Body.String()
+}
+
+// apiCheck calls the JSON check endpoint of the PR, the response is decoded into the model.
+func (e *e2e) apiCheck(number int, model interface{}) int {
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/v1/pr/%d/check", number), nil)
+	req = mux.SetURLVars(req, map[string]string{"number": strconv.Itoa(number)})
+	w := httptest.NewRecorder()
+	e.s.apiCheckHandler(w, req)
+	if err := json.NewDecoder(w.Body).Decode(model); err != nil {
+		e.t.Fatal(err)
+	}
+	return w.Code
+}
+
+func (e *e2e) announcedTopics() []url.Values {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]url.Values{}, e.topics...)
+}
+
+// counterValue reads a series of the counter, the counters are global so the tests compare them before and after.
+func counterValue(c *counterVec, values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.values[labelKey(values)]
+}
+
+func TestE2EOpened(t *testing.T) {
+	e, cleanup := newE2E(t)
+	defer cleanup()
+	pr := e.addStepPR(1, "1.2.0", "1.0.0", "1.1.0", "assets")
+
+	if code := e.deliver("pull_request", e.pullRequestEvent("opened", pr)); code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202", code)
+	}
+
+	body := e.currentPR(1).Body
+	for _, want := range []string{e.lib.badgeURL(1), "https://github.com/bitrise-steplib/steps-script/releases/1.2.0", resultsBegin, "| script | 1.2.0 | :white_check_mark: passed |", "Release 1.2.0"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body misses %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, e.lib.Templates.NewStep) {
+		t.Errorf("new step notification on a new version of an existing step:\n%s", body)
+	}
+
+	statuses := e.github.recordedStatuses()
+	if len(statuses) != 1 || statuses[0].SHA != "head1" || statuses[0].State != "success" || statuses[0].Context != checkRunName {
+		t.Errorf("statuses = %v, want one successful status of head1", statuses)
+	}
+
+	if svg := e.badge(1); !strings.Contains(svg, "✔") {
+		t.Errorf("badge is not passing:\n%s", svg)
+	}
+}
+
+func TestE2EOpenedNewStep(t *testing.T) {
+	e, cleanup := newE2E(t)
+	defer cleanup()
+	pr := e.addStepPR(2, "1.0.0")
+
+	e.deliver("pull_request", e.pullRequestEvent("opened", pr))
+
+	if body := e.currentPR(2).Body; !strings.HasSuffix(body, e.lib.Templates.NewStep) {
+		t.Errorf("body misses the new step notification:\n%s", body)
+	}
+}
+
+func TestE2EReopened(t *testing.T) {
+	e, cleanup := newE2E(t)
+	defer cleanup()
+	pr := e.addStepPR(1, "1.2.0", "1.1.0")
+
+	e.deliver("pull_request", e.pullRequestEvent("opened", pr))
+	updates := e.github.updatedBodies()
+
+	if code := e.deliver("pull_request", e.pullRequestEvent("reopened", e.currentPR(1))); code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202", code)
+	}
+
+	if got := e.github.updatedBodies(); got != updates {
+		t.Errorf("up to date body updated again, %d updates, want %d", got, updates)
+	}
+	if statuses := e.github.recordedStatuses(); len(statuses) != 2 {
+		t.Errorf("%d statuses, want one per event", len(statuses))
+	}
+}
+
+func TestE2ESynchronize(t *testing.T) {
+	e, cleanup := newE2E(t)
+	defer cleanup()
+	pr := e.addStepPR(1, "1.2.0", "1.1.0")
+
+	e.deliver("pull_request", e.pullRequestEvent("opened", pr))
+	if svg := e.badge(1); !strings.Contains(svg, "✔") {
+		t.Fatalf("badge is not passing:\n%s", svg)
+	}
+
+	// the push points the step at a commit the tag is not at, so the cached verdict is stale
+	pushed := e.currentPR(1)
+	pushed.Head.SHA = "head1-pushed"
+	e.github.addPullRequest(pushed, map[string]string{"steps/script/1.2.0/step.yml": stepYML(e2eNewCommit)})
+
+	if code := e.deliver("pull_request", e.pullRequestEvent("synchronize", pushed)); code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202", code)
+	}
+
+	statuses := e.github.recordedStatuses()
+	if len(statuses) != 2 || statuses[1].SHA != "head1-pushed" || statuses[1].State != "failure" {
+		t.Errorf("statuses = %v, want a failed status of the pushed head", statuses)
+	}
+	if body := e.currentPR(1).Body; !strings.Contains(body, "Tag points at another commit") {
+		t.Errorf("results table is not refreshed:\n%s", body)
+	}
+	if svg := e.badge(1); strings.Contains(svg, "✔") {
+		t.Errorf("badge still passing after the tag moved:\n%s", svg)
+	}
+}
+
+func TestE2EEdited(t *testing.T) {
+	e, cleanup := newE2E(t)
+	defer cleanup()
+	pr := e.addStepPR(1, "1.2.0", "1.1.0")
+
+	// the author replaced the body, dropping the badge and the results
+	edited := pr
+	edited.Body = "Rewritten description"
+	e.github.addPullRequest(edited, map[string]string{"steps/script/1.2.0/step.yml": stepYML(e2eCommit)})
+
+	t.Run("title change", func(t *testing.T) {
+		event := e.pullRequestEvent("edited", edited)
+		event["changes"] = map[string]interface{}{"title": map[string]string{"from": "Old title"}}
+
+		if code := e.deliver("pull_request", event); code != http.StatusAccepted {
+			t.Fatalf("status = %d, want 202", code)
+		}
+		if updates := e.github.updatedBodies(); updates != 0 {
+			t.Errorf("body updated %d times on a title edit", updates)
+		}
+	})
+
+	t.Run("body change", func(t *testing.T) {
+		event := e.pullRequestEvent("edited", edited)
+		event["changes"] = map[string]interface{}{"body": map[string]string{"from": pr.Body}}
+
+		if code := e.deliver("pull_request", event); code != http.StatusAccepted {
+			t.Fatalf("status = %d, want 202", code)
+		}
+		body := e.currentPR(1).Body
+		if !strings.Contains(body, e.lib.badgeURL(1)) || !strings.Contains(body, "Rewritten description") {
+			t.Errorf("badge is not restored in the edited body:\n%s", body)
+		}
+		if statuses := e.github.recordedStatuses(); len(statuses) != 0 {
+			t.Errorf("edits do not report statuses, got %v", statuses)
+		}
+	})
+}
+
+func TestE2EClosed(t *testing.T) {
+	e, cleanup := newE2E(t)
+	defer cleanup()
+	pr := e.addStepPR(1, "1.2.0", "1.1.0")
+
+	closed := pr
+	closed.State = "closed"
+	if code := e.deliver("pull_request", e.pullRequestEvent("closed", closed)); code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202", code)
+	}
+	if topics := e.announcedTopics(); len(topics) != 0 {
+		t.Fatalf("unmerged PR announced: %v", topics)
+	}
+
+	merged := closed
+	merged.Merged = true
+	e.deliver("pull_request", e.pullRequestEvent("closed", merged))
+
+	topics := e.announcedTopics()
+	if len(topics) != 1 {
+		t.Fatalf("%d topics, want 1", len(topics))
+	}
+	topic := topics[0]
+	if topic.Get("title") != "Script v1.2.0" || topic.Get("category") != "step-releases" || topic.Get("api_key") != "key" {
+		t.Errorf("topic = %v", topic)
+	}
+	if raw := topic.Get("raw"); !strings.Contains(raw, "* Faster") || !strings.Contains(raw, "https://github.com/bitrise-steplib/steps-script/releases/1.2.0") {
+		t.Errorf("topic body misses the release notes or link:\n%s", raw)
+	}
+
+	// a second merged event, like a replay, must not announce the release again
+	e.deliver("pull_request", e.pullRequestEvent("closed", merged))
+	if topics := e.announcedTopics(); len(topics) != 1 {
+		t.Errorf("release announced %d times", len(topics))
+	}
+}
+
+func TestE2ERejectedDeliveries(t *testing.T) {
+	e, cleanup := newE2E(t)
+	defer cleanup()
+	pr := e.addStepPR(1, "1.2.0", "1.1.0")
+
+	unknown := e.pullRequestEvent("opened", pr)
+	unknown["repository"] = map[string]string{"full_name": "someone/else"}
+	if code := e.deliver("pull_request", unknown); code != http.StatusForbidden {
+		t.Errorf("unknown repository status = %d, want 403", code)
+	}
+
+	payload, err := json.Marshal(e.pullRequestEvent("opened", pr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := e.deliverRaw("pull_request", payload, sign(payload, "wrong")); code != http.StatusUnauthorized {
+		t.Errorf("bad signature status = %d, want 401", code)
+	}
+
+	if code := e.deliver("push", e.pullRequestEvent("opened", pr)); code != http.StatusOK {
+		t.Errorf("push event status = %d, want 200", code)
+	}
+
+	if updates, statuses := e.github.updatedBodies(), e.github.recordedStatuses(); updates != 0 || len(statuses) != 0 {
+		t.Errorf("rejected deliveries were processed: %d body updates, %d statuses", updates, len(statuses))
+	}
+	if records, err := recentDeliveries(0); err != nil || len(records) != 0 {
+		t.Errorf("rejected deliveries were recorded: %+v, %v", records, err)
+	}
+}
+
+func TestE2EAPICheck(t *testing.T) {
+	e, cleanup := newE2E(t)
+	defer cleanup()
+	e.addStepPR(1, "1.2.0", "1.1.0")
+
+	var check apiCheck
+	if code := e.apiCheck(1, &check); code != http.StatusOK || !check.Passed || len(check.Steps) != 1 {
+		t.Errorf("check = %d %+v", code, check)
+	}
+
+	// the errors are only logged, they can carry the details of the hosts the server reached
+	var apiErr apiError
+	if code := e.apiCheck(2, &apiErr); code != http.StatusBadGateway || apiErr.Error != "failed to check the PR" {
+		t.Errorf("error response = %d %+v", code, apiErr)
+	}
+}
+
+func TestE2EMalformedDelivery(t *testing.T) {
+	e, cleanup := newE2E(t)
+	defer cleanup()
+
+	before := counterValue(webhookEvents, "", "", "bad_request")
+	payload := []byte(`{"action":"opened","repository":`)
+	if code := e.deliverRaw("pull_request", payload, sign(payload, e2eSecret)); code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", code)
+	}
+	if got := counterValue(webhookEvents, "", "", "bad_request"); got != before+1 {
+		t.Errorf("bad_request deliveries = %v, want %v", got, before+1)
+	}
+	if records, err := recentDeliveries(0); err != nil || len(records) != 0 {
+		t.Errorf("malformed delivery was recorded: %+v, %v", records, err)
+	}
+}
+
+func TestE2EDuplicateDelivery(t *testing.T) {
+	e, cleanup := newE2E(t)
+	defer cleanup()
+	pr := e.addStepPR(1, "1.2.0", "1.1.0")
+
+	payload, err := json.Marshal(e.pullRequestEvent("opened", pr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := e.redeliver("delivery-1", "pull_request", payload, sign(payload, e2eSecret)); code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202", code)
+	}
+
+	before := counterValue(webhookEvents, "pull_request", "opened", "duplicate")
+	if code := e.redeliver("delivery-1", "pull_request", payload, sign(payload, e2eSecret)); code != http.StatusOK {
+		t.Errorf("duplicate status = %d, want 200", code)
+	}
+	if got := counterValue(webhookEvents, "pull_request", "opened", "duplicate"); got != before+1 {
+		t.Errorf("duplicate deliveries = %v, want %v", got, before+1)
+	}
+	if statuses := e.github.recordedStatuses(); len(statuses) != 1 {
+		t.Errorf("duplicate delivery was processed again: %v", statuses)
+	}
+}
+
+func TestE2EQueueFull(t *testing.T) {
+	e, cleanup := newE2E(t)
+	defer cleanup()
+	pr := e.addStepPR(1, "1.2.0", "1.1.0")
+
+	// the worker is stuck on a job and its shard is full
+	release := make(chan struct{})
+	e.s.jobs = newJobQueue(1, 1, func(j *job) error {
+		<-release
+		return nil
+	})
+	for e.s.jobs.enqueue(&job{Repo: e2eRepo, PR: 1}) == nil {
+	}
+
+	payload, err := json.Marshal(e.pullRequestEvent("opened", pr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := e.post("delivery-1", "pull_request", payload, sign(payload, e2eSecret)); code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", code)
+	}
+	close(release)
+	if err := e.s.jobs.drain(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// the delivery is forgotten, so the redelivery of GitHub is processed
+	if records, err := recentDeliveries(0); err != nil || len(records) != 0 {
+		t.Errorf("rejected delivery is still recorded: %+v, %v", records, err)
+	}
+	if code := e.redeliver("delivery-1", "pull_request", payload, sign(payload, e2eSecret)); code != http.StatusAccepted {
+		t.Errorf("redelivery status = %d, want 202", code)
+	}
+	if statuses := e.github.recordedStatuses(); len(statuses) != 1 {
+		t.Errorf("statuses = %v, want the one of the redelivery", statuses)
+	}
+}
+
+func TestE2EIgnoredPullRequests(t *testing.T) {
+	e, cleanup := newE2E(t)
+	defer cleanup()
+
+	docs := content{State: "open", Number: 1, Body: "Fix typo"}
+	docs.Head.SHA = "head1"
+	e.github.addPullRequest(docs, map[string]string{"README.md": "readme"})
+	if code := e.deliver("pull_request", e.pullRequestEvent("opened", docs)); code != http.StatusAccepted {
+		t.Errorf("PR without step.yml status = %d, want 202", code)
+	}
+
+	pr := e.addStepPR(2, "1.2.0", "1.1.0")
+	before := counterValue(webhookEvents, "pull_request", "other", "queued")
+	if code := e.deliver("pull_request", e.pullRequestEvent("labeled", pr)); code != http.StatusAccepted {
+		t.Errorf("labeled status = %d, want 202", code)
+	}
+	if got := counterValue(webhookEvents, "pull_request", "other", "queued"); got != before+1 {
+		t.Errorf("labeled deliveries = %v, want %v", got, before+1)
+	}
+
+	if updates, statuses := e.github.updatedBodies(), e.github.recordedStatuses(); updates != 0 || len(statuses) != 0 {
+		t.Errorf("ignored PRs were processed: %d body updates, statuses %v", updates, statuses)
+	}
+	records, err := recentDeliveries(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		if record.Status != deliveryDone {
+			t.Errorf("delivery %s is %s, want done", record.ID, record.Status)
+		}
+	}
+}
+
+func TestE2EBadgeErrors(t *testing.T) {
+	e, cleanup := newE2E(t)
+	defer cleanup()
+
+	docs := content{State: "open", Number: 1, Body: "Fix typo"}
+	docs.Head.SHA = "head1"
+	e.github.addPullRequest(docs, map[string]string{"README.md": "readme"})
+
+	for _, tc := range []struct {
+		name    string
+		query   string
+		reason  string
+		message string
+	}{
+		{"invalid pr", "pr=abc", "invalid_pr", "error"},
+		{"unknown repo", "repo=someone/steplib&pr=1", "unknown_repo", "error"},
+		{"no step.yml", "pr=1", "no_step_yml", "error"},
+		{"missing pr", "pr=2", "check_failed", "error"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			before := counterValue(badgeVerdicts, "error", tc.reason)
+			if svg := e.badgeOf(tc.query); !strings.Contains(svg, tc.message) {
+				t.Errorf("badge misses %q:\n%s", tc.message, svg)
+			}
+			if got := counterValue(badgeVerdicts, "error", tc.reason); got != before+1 {
+				t.Errorf("%s badges = %v, want %v", tc.reason, got, before+1)
+			}
+		})
+	}
+
+	t.Run("rate limited", func(t *testing.T) {
+		e.addStepPR(3, "1.2.0", "1.1.0")
+		e.github.exhaustRateLimit()
+
+		before := counterValue(badgeVerdicts, "error", "rate_limited")
+		if svg := e.badge(3); !strings.Contains(svg, rateLimitedBadge().Message) {
+			t.Errorf("badge is not the rate limited one:\n%s", svg)
+		}
+		if got := counterValue(badgeVerdicts, "error", "rate_limited"); got != before+1 {
+			t.Errorf("rate_limited badges = %v, want %v", got, before+1)
+		}
+	})
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// fakeGithub serves the GitHub REST API endpoints the checks and the webhook actions call from memory,
+// for running them through restGithub without GitHub. It records the PR body updates and the commit statuses.
+type fakeGithub struct {
+	router *mux.Router
+
+	mu           sync.Mutex
+	pullRequests map[int]content
+	files        map[int][]file
+	raw          map[string][]byte
+	dirs         map[string][]contentEntry
+	tags         map[string]tagTarget
+	tagObjects   map[string]githubObject
+	releases     map[string]string
+	statuses     []fakeStatus
+	bodyUpdates  int
+	rateLimited  bool
+}
+
+// fakeStatus is a commit status created through the statuses API.
+type fakeStatus struct {
+	SHA string
+	commitStatus
+}
+
+func newFakeGithub() *fakeGithub {
+	g := &fakeGithub{
+		pullRequests: map[int]content{},
+		files:        map[int][]file{},
+		raw:          map[string][]byte{},
+		dirs:         map[string][]contentEntry{},
+		tags:         map[string]tagTarget{},
+		tagObjects:   map[string]githubObject{},
+		releases:     map[string]string{},
+	}
+
+	g.router = mux.NewRouter()
+	g.router.HandleFunc("/repos/{owner}/{repo}/pulls/{number:[0-9]+}", g.servePullRequest).Methods("GET")
+	g.router.HandleFunc("/repos/{owner}/{repo}/pulls/{number:[0-9]+}", g.serveUpdatePullRequest).Methods("PATCH")
+	g.router.HandleFunc("/repos/{owner}/{repo}/pulls/{number:[0-9]+}/files", g.serveFiles).Methods("GET")
+	g.router.HandleFunc("/repos/{owner}/{repo}/contents/{path:.+}", g.serveContents).Methods("GET")
+	g.router.HandleFunc("/repos/{owner}/{repo}/git/refs/tags/{tag}", g.serveTagRef).Methods("GET")
+	g.router.HandleFunc("/repos/{owner}/{repo}/git/tags/{sha}", g.serveTagObject).Methods("GET")
+	g.router.HandleFunc("/repos/{owner}/{repo}/releases/tags/{tag}", g.serveRelease).Methods("GET")
+	g.router.HandleFunc("/repos/{owner}/{repo}/statuses/{sha}", g.serveCreateStatus).Methods("POST")
+	return g
+}
+
+// newFakeSteplib returns the default steplib with its GitHub API served by the fake, until the test ends.
+func newFakeSteplib(t *testing.T, g *fakeGithub) *steplib {
+	server := httptest.NewServer(g)
+	t.Cleanup(server.Close)
+
+	lib := defaultSteplib()
+	lib.github = restGithub{client: newTestGithubClient(server, basicAuth{user: "bitrise-bot", token: "token"}), lib: &lib}
+	return &lib
+}
+
+func fakeTagKey(giturl, tag string) string {
+	return strings.TrimSuffix(giturl, ".git") + "@" + tag
+}
+
+// addPullRequest adds the PR with its changed files, their content is served at the head SHA of the PR.
+func (g *fakeGithub) addPullRequest(pr content, files map[string]string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.pullRequests[pr.Number] = pr
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	g.files[pr.Number] = nil
+	for _, name := range names {
+		g.files[pr.Number] = append(g.files[pr.Number], file{Filename: name, Status: "added"})
+		g.raw[pr.Head.SHA+":"+name] = []byte(files[name])
+	}
+}
+
+// addDir adds a directory of the steplib repository with the given subdirectories.
+func (g *fakeGithub) addDir(path string, dirs ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.dirs[path] = nil
+	for _, dir := range dirs {
+		g.dirs[path] = append(g.dirs[path], contentEntry{Name: dir, Type: "dir"})
+	}
+}
+
+// addTag adds the tag of the step repository, the TagObjects of the target are served as a chain of annotated tags.
+func (g *fakeGithub) addTag(giturl, tag string, target tagTarget) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.tags[fakeTagKey(giturl, tag)] = target
+	for i, sha := range target.TagObjects {
+		next := githubObject{Type: target.Type, SHA: target.SHA}
+		if i+1 < len(target.TagObjects) {
+			next = githubObject{Type: "tag", SHA: target.TagObjects[i+1]}
+		}
+		g.tagObjects[sha] = next
+	}
+}
+
+func (g *fakeGithub) addRelease(giturl, tag, body string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.releases[fakeTagKey(giturl, tag)] = body
+}
+
+// exhaustRateLimit makes every further request fail as GitHub does once the rate limit is used up.
+func (g *fakeGithub) exhaustRateLimit() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.rateLimited = true
+}
+
+// currentPullRequest returns the PR as it is now, with the body updates.
+func (g *fakeGithub) currentPullRequest(pr int) (content, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	pullRequest, ok := g.pullRequests[pr]
+	return pullRequest, ok
+}
+
+// updatedBodies returns how many times a PR body was updated.
+func (g *fakeGithub) updatedBodies() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.bodyUpdates
+}
+
+// recordedStatuses returns the commit statuses created so far.
+func (g *fakeGithub) recordedStatuses() []fakeStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return append([]fakeStatus{}, g.statuses...)
+}
+
+// ServeHTTP rejects the requests without credentials and answers with the rate limit headers GitHub sends.
+func (g *fakeGithub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	rateLimited := g.rateLimited
+	g.mu.Unlock()
+
+	reset := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	w.Header().Set("X-RateLimit-Limit", "5000")
+	w.Header().Set("X-RateLimit-Reset", reset)
+	if rateLimited {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		writeFakeJSON(w, r, http.StatusForbidden, map[string]string{"message": "API rate limit exceeded"})
+		return
+	}
+	w.Header().Set("X-RateLimit-Remaining", "4999")
+
+	if r.Header.Get("Authorization") == "" {
+		writeFakeJSON(w, r, http.StatusUnauthorized, map[string]string{"message": "Requires authentication"})
+		return
+	}
+
+	g.router.ServeHTTP(w, r)
+}
+
+// writeFakeJSON writes the model with an ETag, and answers 304 to the requests which already have it.
+func writeFakeJSON(w http.ResponseWriter, r *http.Request, status int, model interface{}) {
+	b, err := json.Marshal(model)
+	if err != nil {
+		panic(err)
+	}
+	writeFakeBody(w, r, status, "application/json", b)
+}
+
+func writeFakeBody(w http.ResponseWriter, r *http.Request, status int, contentType string, b []byte) {
+	sum := sha1.Sum(b)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+
+	w.Header().Set("Content-Type", contentType)
+	if status == http.StatusOK {
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.WriteHeader(status)
+	if _, err := w.Write(b); err != nil {
+		panic(err)
+	}
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeFakeJSON(w, r, http.StatusNotFound, map[string]string{"message": "Not Found"})
+}
+
+func prNumber(r *http.Request) int {
+	number, err := strconv.Atoi(mux.Vars(r)["number"])
+	if err != nil {
+		panic(err)
+	}
+	return number
+}
+
+// sourceURL is the github.com URL of the repository the request is for, as the step.yml files refer to it.
+func sourceURL(r *http.Request) string {
+	return "https://github.com/" + mux.Vars(r)["owner"] + "/" + mux.Vars(r)["repo"]
+}
+
+func (g *fakeGithub) servePullRequest(w http.ResponseWriter, r *http.Request) {
+	pullRequest, ok := g.currentPullRequest(prNumber(r))
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	writeFakeJSON(w, r, http.StatusOK, pullRequest)
+}
+
+func (g *fakeGithub) serveUpdatePullRequest(w http.ResponseWriter, r *http.Request) {
+	var update struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeFakeJSON(w, r, http.StatusBadRequest, map[string]string{"message": "Problems parsing JSON"})
+		return
+	}
+
+	g.mu.Lock()
+	pullRequest, ok := g.pullRequests[prNumber(r)]
+	if ok {
+		pullRequest.Body = update.Body
+		g.pullRequests[pullRequest.Number] = pullRequest
+		g.bodyUpdates++
+	}
+	g.mu.Unlock()
+
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	writeFakeJSON(w, r, http.StatusOK, pullRequest)
+}
+
+func (g *fakeGithub) serveFiles(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	files, ok := g.files[prNumber(r)]
+	g.mu.Unlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	perPage, err := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if err != nil || perPage < 1 {
+		perPage = 30
+	}
+
+	batch := []file{}
+	if start := (page - 1) * perPage; start < len(files) {
+		end := start + perPage
+		if end > len(files) {
+			end = len(files)
+		}
+		batch = files[start:end]
+	}
+	writeFakeJSON(w, r, http.StatusOK, batch)
+}
+
+// serveContents serves the raw file at the ref, or the listing of the directory on the default branch without one.
+func (g *fakeGithub) serveContents(w http.ResponseWriter, r *http.Request) {
+	path := mux.Vars(r)["path"]
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if ref := r.URL.Query().Get("ref"); ref != "" {
+		b, ok := g.raw[ref+":"+path]
+		if !ok || r.Header.Get("Accept") != "application/vnd.github.raw" {
+			notFound(w, r)
+			return
+		}
+		writeFakeBody(w, r, http.StatusOK, "application/vnd.github.raw", b)
+		return
+	}
+
+	entries, ok := g.dirs[path]
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	writeFakeJSON(w, r, http.StatusOK, entries)
+}
+
+func (g *fakeGithub) serveTagRef(w http.ResponseWriter, r *http.Request) {
+	tag := mux.Vars(r)["tag"]
+
+	g.mu.Lock()
+	target, ok := g.tags[fakeTagKey(sourceURL(r), tag)]
+	g.mu.Unlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+
+	object := githubObject{Type: target.Type, SHA: target.SHA}
+	if len(target.TagObjects) > 0 {
+		object = githubObject{Type: "tag", SHA: target.TagObjects[0]}
+	}
+	writeFakeJSON(w, r, http.StatusOK, githubRef{Ref: "refs/tags/" + tag, Object: object})
+}
+
+func (g *fakeGithub) serveTagObject(w http.ResponseWriter, r *http.Request) {
+	sha := mux.Vars(r)["sha"]
+
+	g.mu.Lock()
+	object, ok := g.tagObjects[sha]
+	g.mu.Unlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	writeFakeJSON(w, r, http.StatusOK, githubTagObject{SHA: sha, Object: object})
+}
+
+func (g *fakeGithub) serveRelease(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	body, ok := g.releases[fakeTagKey(sourceURL(r), mux.Vars(r)["tag"])]
+	g.mu.Unlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	writeFakeJSON(w, r, http.StatusOK, githubrelease{Body: body})
+}
+
+func (g *fakeGithub) serveCreateStatus(w http.ResponseWriter, r *http.Request) {
+	var status commitStatus
+	if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+		writeFakeJSON(w, r, http.StatusBadRequest, map[string]string{"message": "Problems parsing JSON"})
+		return
+	}
+
+	g.mu.Lock()
+	g.statuses = append(g.statuses, fakeStatus{SHA: mux.Vars(r)["sha"], commitStatus: status})
+	g.mu.Unlock()
+
+	writeFakeJSON(w, r, http.StatusCreated, status)
+}
+
+// String helps reading the failures of the tests.
+func (s fakeStatus) String() string {
+	return fmt.Sprintf("%s %s %q", s.SHA, s.State, s.Description)
+}
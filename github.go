@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	githubMaxRetries = 3
+	// githubMaxWait is the longest a request waits for the rate limit to reset or for a Retry-After,
+	// longer waits fail with rateLimitError instead of blocking the badge or webhook.
+	githubMaxWait = 10 * time.Second
+	// githubAPIHost is the only host credentials are sent to, raw file and release URLs are fetched anonymously.
+	githubAPIHost = "api.github.com"
+	// githubPageSize is the largest page the list endpoints return
+	githubPageSize = 100
+)
+
+// githubRetryDelay is the first backoff after a server error, doubled on every further attempt.
+var githubRetryDelay = time.Second
+
+type rateLimit struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+type rateLimitError struct {
+	Reset time.Time
+}
+
+func (e rateLimitError) Error() string {
+	return fmt.Sprintf("GitHub API rate limit exceeded, resets at %s", e.Reset.Format(time.RFC3339))
+}
+
+func isRateLimitError(err error) bool {
+	_, ok := err.(rateLimitError)
+	return ok
+}
+
+type githubResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+type githubClient struct {
+	client *http.Client
+	auth   githubAuth
+	cache  *responseCache
+
+	mu        sync.Mutex
+	rateLimit rateLimit
+}
+
+func newGithubClient(auth githubAuth) *githubClient {
+	size, err := strconv.Atoi(os.Getenv("GITHUB_CACHE_SIZE"))
+	if err != nil || size <= 0 {
+		size = defaultCacheSize
+	}
+
+	return &githubClient{
+		client: &http.Client{Timeout: 30 * time.Second, Transport: httpTransport},
+		auth:   auth,
+		cache:  newResponseCache(size),
+	}
+}
+
+// RateLimit returns the rate limit state reported by the last response.
+func (c *githubClient) RateLimit() rateLimit {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rateLimit
+}
+
+func (c *githubClient) updateRateLimit(header http.Header) {
+	limit, err := strconv.Atoi(header.Get("X-RateLimit-Limit"))
+	if err != nil {
+		return
+	}
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rateLimit = rateLimit{Limit: limit, Remaining: remaining, Reset: time.Unix(reset, 0)}
+}
+
+// exhausted returns a rateLimitError if the last response used up the quota and the reset is not due yet.
+func (c *githubClient) exhausted() error {
+	limit := c.RateLimit()
+	if limit.Limit > 0 && limit.Remaining == 0 && time.Now().Before(limit.Reset) {
+		return rateLimitError{Reset: limit.Reset}
+	}
+	return nil
+}
+
+// do sends the request, retrying on rate limiting if the limit resets soon enough, as GitHub rejected the request then.
+// Network and server errors are retried for GET requests only, a POST or PATCH might have been applied already,
+// so retrying it could create a second check run or overwrite newer edits.
+func (c *githubClient) do(method, url string, body []byte, header http.Header) (githubResponse, error) {
+	idempotent := method == "GET" || method == "HEAD"
+
+	for attempt := 0; ; attempt++ {
+		if err := c.exhausted(); err != nil {
+			return githubResponse{}, err
+		}
+
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			return githubResponse{}, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if err := c.authorize(req); err != nil {
+			return githubResponse{}, err
+		}
+
+		resp, err := c.roundTrip(req)
+		if err != nil {
+			if idempotent && attempt < githubMaxRetries {
+				time.Sleep(backoff(attempt))
+				continue
+			}
+			return githubResponse{}, err
+		}
+
+		wait, retry, err := c.retryAfter(resp, attempt)
+		if err != nil {
+			return githubResponse{}, err
+		}
+		if !retry || (resp.StatusCode >= 500 && !idempotent) {
+			return resp, nil
+		}
+
+		logger.with("method", method).with("url", url).with("status", resp.StatusCode).infof("retrying GitHub request after %s", wait)
+		time.Sleep(wait)
+	}
+}
+
+// roundTripWithAuth sends a single authorized request, without retries or caching.
+func (c *githubClient) roundTripWithAuth(method, url string) (githubResponse, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return githubResponse{}, err
+	}
+	if err := c.authorize(req); err != nil {
+		return githubResponse{}, err
+	}
+	return c.roundTrip(req)
+}
+
+// authorize adds credentials only to requests for the GitHub API, so URLs taken from PR content never receive them.
+func (c *githubClient) authorize(req *http.Request) error {
+	if req.URL.Host != githubAPIHost {
+		return nil
+	}
+	return c.auth.authorize(req)
+}
+
+func (c *githubClient) roundTrip(req *http.Request) (githubResponse, error) {
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		githubLatency.observeSince(start, req.Method, "error")
+		return githubResponse{}, err
+	}
+	githubLatency.observeSince(start, req.Method, strconv.Itoa(resp.StatusCode))
+
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.withError(err).warnf("failed to close body")
+		}
+	}()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return githubResponse{}, err
+	}
+
+	c.updateRateLimit(resp.Header)
+
+	return githubResponse{StatusCode: resp.StatusCode, Header: resp.Header, Body: b}, nil
+}
+
+// retryAfter decides if the response is worth retrying and how long to wait before,
+// it returns a rateLimitError if the rate limit is exhausted for longer than githubMaxWait.
+func (c *githubClient) retryAfter(resp githubResponse, attempt int) (time.Duration, bool, error) {
+	switch {
+	case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests:
+		var wait time.Duration
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			// secondary rate limit
+			wait = time.Duration(seconds) * time.Second
+		} else if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+			wait = time.Until(c.RateLimit().Reset)
+		} else if resp.StatusCode == http.StatusForbidden {
+			// permission error, retrying does not help
+			return 0, false, nil
+		} else {
+			wait = backoff(attempt)
+		}
+
+		reset := time.Now().Add(wait)
+		if wait > githubMaxWait || attempt >= githubMaxRetries {
+			return 0, false, rateLimitError{Reset: reset}
+		}
+		return wait, true, nil
+	case resp.StatusCode >= 500:
+		return backoff(attempt), attempt < githubMaxRetries, nil
+	default:
+		return 0, false, nil
+	}
+}
+
+func backoff(attempt int) time.Duration {
+	return githubRetryDelay * time.Duration(math.Pow(2, float64(attempt)))
+}
+
+// get loads the resource, any status code other than 200 and 404 is an error.
+// Responses are cached, fresh entries are served without a request and stale ones are revalidated
+// with a conditional request, 304 responses do not count against the rate limit.
+func (c *githubClient) get(url string) (body []byte, found bool, err error) {
+	return c.load(url, "", false)
+}
+
+// getCurrent loads the resource like get, but a cached response is always revalidated,
+// for the resources which change with a push, like the head and the files of a PR.
+func (c *githubClient) getCurrent(url string) (body []byte, found bool, err error) {
+	return c.load(url, "", true)
+}
+
+// getMedia loads the resource in the media type of the Accept header, like get,
+// the responses of each media type are cached separately.
+func (c *githubClient) getMedia(url, mediaType string) (body []byte, found bool, err error) {
+	return c.load(url, mediaType, false)
+}
+
+func (c *githubClient) load(url, mediaType string, revalidate bool) (body []byte, found bool, err error) {
+	now := time.Now()
+
+	key := url
+	if mediaType != "" {
+		key = mediaType + " " + url
+	}
+
+	cached, ok := c.cache.get(key)
+	if ok && !revalidate && cached.fresh(now) {
+		return cached.body, true, nil
+	}
+
+	header := http.Header{}
+	if mediaType != "" {
+		header.Set("Accept", mediaType)
+	}
+	if ok && cached.etag != "" {
+		header.Set("If-None-Match", cached.etag)
+	}
+	if ok && cached.lastModified != "" {
+		header.Set("If-Modified-Since", cached.lastModified)
+	}
+
+	resp, err := c.do("GET", url, nil, header)
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && ok:
+		cached.expires = now.Add(cacheTTL(url))
+		c.cache.add(cached)
+		return cached.body, true, nil
+	case resp.StatusCode == http.StatusOK:
+		c.cache.add(cacheEntry{
+			key:          key,
+			etag:         resp.Header.Get("ETag"),
+			lastModified: resp.Header.Get("Last-Modified"),
+			body:         resp.Body,
+			expires:      now.Add(cacheTTL(url)),
+		})
+		return resp.Body, true, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("Invalid response code: %d from: %s, body: %s", resp.StatusCode, url, string(resp.Body))
+	}
+}
+
+func (c *githubClient) send(method, url string, body []byte) error {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("Accept", "application/vnd.github.antiope-preview+json")
+
+	resp, err := c.do(method, url, body, header)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Invalid response code: %d from: %s %s, body: %s", resp.StatusCode, method, url, string(resp.Body))
+	}
+
+	return nil
+}
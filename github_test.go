@@ -0,0 +1,441 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGithubClientAuthorizesOnlyAPIHost(t *testing.T) {
+	var gotAuth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	c := newGithubClient(basicAuth{user: "bot", token: "secret"})
+	if _, err := c.roundTripWithAuth("GET", server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if gotAuth != "" {
+		t.Errorf("credentials sent to %s: %q", server.URL, gotAuth)
+	}
+	if _, err := c.do("GET", server.URL, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if gotAuth != "" {
+		t.Errorf("credentials sent to %s: %q", server.URL, gotAuth)
+	}
+
+	req, err := http.NewRequest("GET", "https://api.github.com/rate_limit", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.authorize(req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get("Authorization") == "" {
+		t.Error("no credentials on a GitHub API request")
+	}
+}
+
+func TestGithubAPIRepoURL(t *testing.T) {
+	for _, tc := range []struct {
+		giturl string
+		want   string
+	}{
+		{"https://github.com/bitrise-steplib/steps-script.git", "https://api.github.com/repos/bitrise-steplib/steps-script"},
+		{"https://github.com/bitrise-steplib/steps-script", "https://api.github.com/repos/bitrise-steplib/steps-script"},
+		{"https://gitlab.com/owner/repo.git", ""},
+		{"https://evil.example/https://github.com/owner/repo", ""},
+		{"https://github.com/owner/repo/../../users", ""},
+		{"https://github.com/owner/..", ""},
+		{"git@github.com:owner/repo.git", ""},
+	} {
+		got, err := githubAPIRepoURL(tc.giturl)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("githubAPIRepoURL(%q) = %q, want error", tc.giturl, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("githubAPIRepoURL(%q) = %q, %v, want %q", tc.giturl, got, err, tc.want)
+		}
+	}
+}
+
+type recordingTransport struct {
+	requests []*http.Request
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests = append(t.requests, req)
+	return &http.Response{StatusCode: http.StatusCreated, Body: ioutil.NopCloser(strings.NewReader("{}")), Header: http.Header{}, Request: req}, nil
+}
+
+func TestCreateCheckRunFallsBackToCommitStatus(t *testing.T) {
+	run := checkRun{Name: checkRunName, HeadSHA: "abc123", Conclusion: "failure", Output: checkRunOutput{Title: "Tag check failed for 1 of 1 step(s)"}}
+
+	for _, tc := range []struct {
+		name string
+		auth githubAuth
+		path string
+		body string
+	}{
+		{"basic auth", basicAuth{user: "bot", token: "token"}, "/repos/bitrise-io/bitrise-steplib/statuses/abc123",
+			`{"state":"failure","description":"Tag check failed for 1 of 1 step(s)","context":"Tag check"}`},
+		{"GitHub App", &appAuth{token: "token", expiresAt: time.Now().Add(time.Hour)}, "/repos/bitrise-io/bitrise-steplib/check-runs", `"head_sha":"abc123"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			transport := &recordingTransport{}
+			lib := defaultSteplib()
+			c := newGithubClient(tc.auth)
+			c.client.Transport = transport
+
+			if err := (restGithub{client: c, lib: &lib}).createCheckRun(run); err != nil {
+				t.Fatal(err)
+			}
+			if len(transport.requests) != 1 {
+				t.Fatalf("%d requests, want 1", len(transport.requests))
+			}
+			req := transport.requests[0]
+			if req.Method != "POST" || req.URL.Path != tc.path {
+				t.Errorf("request = %s %s, want POST %s", req.Method, req.URL.Path, tc.path)
+			}
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(body), tc.body) {
+				t.Errorf("body = %s, want %s", body, tc.body)
+			}
+		})
+	}
+}
+
+func TestNewCommitStatus(t *testing.T) {
+	status := newCommitStatus(checkRun{Conclusion: "success", Output: checkRunOutput{Title: strings.Repeat("x", 200)}})
+	if status.State != "success" || len(status.Description) != 140 || status.Context != checkRunName {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+// requestCounter counts the requests of a test server, read after the client returned.
+type requestCounter struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (c *requestCounter) next() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n++
+	return c.n - 1
+}
+
+func (c *requestCounter) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+// githubTestServer serves the responses in order, the last one is repeated, and counts the requests.
+func githubTestServer(t *testing.T, responses ...func(w http.ResponseWriter, r *http.Request)) (*httptest.Server, *requestCounter) {
+	requests := &requestCounter{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := requests.next()
+		if i >= len(responses) {
+			i = len(responses) - 1
+		}
+		responses[i](w, r)
+	}))
+	return server, requests
+}
+
+func respond(status int, header map[string]string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for key, value := range header {
+			w.Header().Set(key, value)
+		}
+		w.WriteHeader(status)
+		if _, err := w.Write([]byte(`{}`)); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// dropConnection closes the connection without a response, like a network error after the request was sent.
+func dropConnection(w http.ResponseWriter, r *http.Request) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	if err := conn.Close(); err != nil {
+		panic(err)
+	}
+}
+
+func fastRetries() func() {
+	previous := githubRetryDelay
+	githubRetryDelay = time.Millisecond
+	return func() { githubRetryDelay = previous }
+}
+
+func TestGithubClientRetries(t *testing.T) {
+	defer fastRetries()()
+
+	ok := respond(http.StatusOK, nil)
+	for _, tc := range []struct {
+		name      string
+		method    string
+		responses []func(w http.ResponseWriter, r *http.Request)
+		requests  int
+		status    int
+		err       bool
+	}{
+		{name: "GET retried on server error", method: "GET", responses: []func(http.ResponseWriter, *http.Request){respond(502, nil), respond(500, nil), ok}, requests: 3, status: 200},
+		{name: "GET gives up after the retries", method: "GET", responses: []func(http.ResponseWriter, *http.Request){respond(500, nil)}, requests: githubMaxRetries + 1, status: 500},
+		{name: "GET retried on network error", method: "GET", responses: []func(http.ResponseWriter, *http.Request){dropConnection, ok}, requests: 2, status: 200},
+		{name: "POST not retried on server error", method: "POST", responses: []func(http.ResponseWriter, *http.Request){respond(502, nil), ok}, requests: 1, status: 502},
+		{name: "PATCH not retried on network error", method: "PATCH", responses: []func(http.ResponseWriter, *http.Request){dropConnection, ok}, requests: 1, err: true},
+		{name: "POST retried after Retry-After", method: "POST", responses: []func(http.ResponseWriter, *http.Request){respond(403, map[string]string{"Retry-After": "0"}), ok}, requests: 2, status: 200},
+		{name: "permission error not retried", method: "GET", responses: []func(http.ResponseWriter, *http.Request){respond(403, nil), ok}, requests: 1, status: 403},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, requests := githubTestServer(t, tc.responses...)
+			defer server.Close()
+
+			resp, err := newGithubClient(basicAuth{}).do(tc.method, server.URL, []byte(`{}`), nil)
+			if (err != nil) != tc.err {
+				t.Fatalf("err = %v, want error %v", err, tc.err)
+			}
+			if resp.StatusCode != tc.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tc.status)
+			}
+			if requests.count() != tc.requests {
+				t.Errorf("%d requests, want %d", requests.count(), tc.requests)
+			}
+		})
+	}
+}
+
+func TestGithubClientRateLimits(t *testing.T) {
+	defer fastRetries()()
+
+	t.Run("Retry-After longer than the max wait", func(t *testing.T) {
+		server, requests := githubTestServer(t, respond(429, map[string]string{"Retry-After": "120"}))
+		defer server.Close()
+
+		_, err := newGithubClient(basicAuth{}).do("GET", server.URL, nil, nil)
+		if !isRateLimitError(err) {
+			t.Fatalf("err = %v, want rateLimitError", err)
+		}
+		if wait := time.Until(err.(rateLimitError).Reset); wait < 110*time.Second {
+			t.Errorf("reset in %s, want about 120s", wait)
+		}
+		if n := requests.count(); n != 1 {
+			t.Errorf("%d requests, want 1", n)
+		}
+	})
+
+	t.Run("exhausted quota", func(t *testing.T) {
+		reset := time.Now().Add(time.Hour).Unix()
+		server, requests := githubTestServer(t, respond(403, map[string]string{
+			"X-RateLimit-Limit": "5000", "X-RateLimit-Remaining": "0", "X-RateLimit-Reset": fmt.Sprint(reset),
+		}))
+		defer server.Close()
+
+		c := newGithubClient(basicAuth{})
+		if _, _, err := c.get(server.URL); !isRateLimitError(err) {
+			t.Fatalf("err = %v, want rateLimitError", err)
+		}
+		if limit := c.RateLimit(); limit.Remaining != 0 || limit.Reset.Unix() != reset {
+			t.Errorf("rate limit = %+v", limit)
+		}
+
+		// no request is sent until the reset
+		if _, _, err := c.get(server.URL + "/other"); !isRateLimitError(err) {
+			t.Errorf("err = %v, want rateLimitError", err)
+		}
+		if n := requests.count(); n != 1 {
+			t.Errorf("%d requests, want 1", n)
+		}
+	})
+
+	t.Run("quota resetting within the max wait", func(t *testing.T) {
+		reset := time.Now().Unix()
+		server, requests := githubTestServer(t,
+			respond(403, map[string]string{"X-RateLimit-Limit": "5000", "X-RateLimit-Remaining": "0", "X-RateLimit-Reset": fmt.Sprint(reset)}),
+			respond(200, map[string]string{"X-RateLimit-Limit": "5000", "X-RateLimit-Remaining": "4999", "X-RateLimit-Reset": fmt.Sprint(reset + 3600)}))
+		defer server.Close()
+
+		if _, found, err := newGithubClient(basicAuth{}).get(server.URL); err != nil || !found {
+			t.Fatalf("get = %v, %v", found, err)
+		}
+		if n := requests.count(); n != 2 {
+			t.Errorf("%d requests, want 2", n)
+		}
+	})
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if got := backoff(attempt); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempt, got, want)
+		}
+	}
+}
+
+// redirectTransport sends the requests of every host to the test server, keeping the path and query.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	redirected := *req
+	u := *req.URL
+	u.Scheme, u.Host = t.target.Scheme, t.target.Host
+	redirected.URL = &u
+	redirected.Header = req.Header.Clone()
+	redirected.Header.Set("X-Original-Host", req.URL.Host)
+	return http.DefaultTransport.RoundTrip(&redirected)
+}
+
+// newTestGithubClient is a githubClient whose GitHub API and github.com requests go to the test server.
+func newTestGithubClient(server *httptest.Server, auth githubAuth) *githubClient {
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		panic(err)
+	}
+	c := newGithubClient(auth)
+	c.client.Transport = redirectTransport{target: target}
+	return c
+}
+
+func TestFileContentIsAuthenticated(t *testing.T) {
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		if _, err := w.Write([]byte("title: Script\n")); err != nil {
+			panic(err)
+		}
+	}))
+	defer server.Close()
+
+	lib := defaultSteplib()
+	lib.Owner, lib.Repo = "bitrise-io", "private-steplib"
+	g := restGithub{client: newTestGithubClient(server, basicAuth{user: "bot", token: "secret"}), lib: &lib}
+
+	b, err := g.fileContent("steps/script/1.2.0/step.yml", "0123456789abcdef0123456789abcdef01234567")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "title: Script\n" {
+		t.Errorf("content = %q", b)
+	}
+
+	if host := got.Header.Get("X-Original-Host"); host != githubAPIHost {
+		t.Errorf("host = %s, want %s", host, githubAPIHost)
+	}
+	if want := "/repos/bitrise-io/private-steplib/contents/steps/script/1.2.0/step.yml"; got.URL.Path != want {
+		t.Errorf("path = %s, want %s", got.URL.Path, want)
+	}
+	if ref := got.URL.Query().Get("ref"); ref != "0123456789abcdef0123456789abcdef01234567" {
+		t.Errorf("ref = %s", ref)
+	}
+	if accept := got.Header.Get("Accept"); accept != "application/vnd.github.raw" {
+		t.Errorf("Accept = %s, want the raw media type", accept)
+	}
+	if user, token, ok := got.BasicAuth(); !ok || user != "bot" || token != "secret" {
+		t.Errorf("request is not authenticated: %q", got.Header.Get("Authorization"))
+	}
+}
+
+// pushServer serves a PR of one step.yml with ETags, push replaces its head and files like a push to the PR branch.
+type pushServer struct {
+	mu          sync.Mutex
+	head        string
+	version     string
+	conditional int
+}
+
+func (s *pushServer) push(head, version string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.head, s.version = head, version
+}
+
+func (s *pushServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var body string
+	switch {
+	case r.URL.Path == "/repos/bitrise-io/bitrise-steplib/pulls/1":
+		body = fmt.Sprintf(`{"number":1,"state":"open","head":{"sha":%q}}`, s.head)
+	case r.URL.Path == "/repos/bitrise-io/bitrise-steplib/pulls/1/files":
+		body = fmt.Sprintf(`[{"filename":"steps/script/%s/step.yml","status":"added"}]`, s.version)
+	case strings.HasPrefix(r.URL.Path, "/repos/bitrise-io/bitrise-steplib/contents/") && r.URL.Query().Get("ref") == s.head:
+		body = "title: Script\nsource:\n  git: https://github.com/bitrise-steplib/steps-script.git\n  commit: " + s.head + "\n"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	etag := fmt.Sprintf(`"%s-%s"`, s.head, r.URL.Path)
+	if r.Header.Get("If-None-Match") != "" {
+		s.conditional++
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("ETag", etag)
+	if _, err := w.Write([]byte(body)); err != nil {
+		panic(err)
+	}
+}
+
+func TestPushWithinCacheTTL(t *testing.T) {
+	github := &pushServer{head: strings.Repeat("1", 40), version: "1.0.0"}
+	server := httptest.NewServer(github)
+	defer server.Close()
+
+	lib := defaultSteplib()
+	lib.client = newTestGithubClient(server, basicAuth{})
+	lib.github = restGithub{client: lib.client, lib: &lib}
+
+	steps := func() string {
+		head, err := loadPRHeadSHA(&lib, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		steps, err := parseSteps(&lib, 1, head)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%s@%s %s", steps[0].ID, steps[0].Version, steps[0].Step.Source.Commit)
+	}
+
+	if got, want := steps(), "script@1.0.0 "+strings.Repeat("1", 40); got != want {
+		t.Fatalf("steps = %s, want %s", got, want)
+	}
+
+	// the cached PR and files are still fresh, but they must not hide the push
+	github.push(strings.Repeat("2", 40), "1.1.0")
+	if got, want := steps(), "script@1.1.0 "+strings.Repeat("2", 40); got != want {
+		t.Errorf("steps after the push = %s, want %s", got, want)
+	}
+	github.mu.Lock()
+	defer github.mu.Unlock()
+	if github.conditional != 2 {
+		t.Errorf("%d conditional requests, want the PR and its files revalidated", github.conditional)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// githubAPI is every GitHub call the checks and the webhook actions make on behalf of a steplib.
+// restGithub talks to the GitHub API, localSteplib reads a local checkout and fakeGithub in the tests serves everything from memory.
+type githubAPI interface {
+	pullRequest(pr int) (content, error)
+	pullRequestFiles(pr int) ([]file, error)
+	// fileContent loads the file of the steplib repository at the ref, the PR head.
+	fileContent(path, ref string) ([]byte, error)
+	// contents lists the directory of the steplib repository, found is false if it does not exist.
+	contents(path string) (entries []contentEntry, found bool, err error)
+	// tag resolves the tag of the step repository, found is false if it does not exist.
+	tag(giturl, tag string) (target tagTarget, found bool, err error)
+	releaseBody(giturl, tag string) (string, error)
+	updatePullRequestBody(pr int, body string) error
+	createCheckRun(run checkRun) error
+}
+
+// restGithub is the githubAPI of a steplib repository, backed by the GitHub REST API.
+type restGithub struct {
+	client *githubClient
+	lib    *steplib
+}
+
+// pullRequest loads the current PR, a push changes its head at any time, so the cached response is revalidated.
+func (g restGithub) pullRequest(pr int) (content, error) {
+	var pullRequest content
+	err := httpLoadCurrentJSON(g.client, g.lib.apiURL("/pulls/%d", pr), &pullRequest)
+	return pullRequest, err
+}
+
+// pullRequestFiles pages through the files of the PR, GitHub lists at most 3000 of them.
+// Like the PR, the files are revalidated, so they belong to the head the webhook or pullRequest returned.
+func (g restGithub) pullRequestFiles(pr int) ([]file, error) {
+	var files []file
+	for page := 1; ; page++ {
+		var batch []file
+		if err := httpLoadCurrentJSON(g.client, g.lib.apiURL("/pulls/%d/files?per_page=%d&page=%d", pr, githubPageSize, page), &batch); err != nil {
+			return nil, err
+		}
+		files = append(files, batch...)
+
+		if len(batch) < githubPageSize {
+			return files, nil
+		}
+	}
+}
+
+// fileContent loads the raw file through the contents API, unlike the raw_url of the PR files it is authenticated,
+// so the step.yml files of private steplibs can be read too.
+func (g restGithub) fileContent(path, ref string) ([]byte, error) {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	u := g.lib.apiURL("/contents/%s?ref=%s", strings.Join(segments, "/"), url.QueryEscape(ref))
+	b, found, err := g.client.getMedia(u, "application/vnd.github.raw")
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("not found: %s at %s", path, ref)
+	}
+	return b, nil
+}
+
+func (g restGithub) contents(path string) ([]contentEntry, bool, error) {
+	var entries []contentEntry
+	found, err := httpLoadJSONIfExists(g.client, g.lib.apiURL("/contents/%s", path), &entries)
+	return entries, found, err
+}
+
+func (g restGithub) tag(giturl, tag string) (tagTarget, bool, error) {
+	if g.lib.usesGitTags(giturl) {
+		return resolveGitTag(giturl, tag)
+	}
+	return resolveGithubTag(g.client, giturl, tag)
+}
+
+func (g restGithub) releaseBody(giturl, tag string) (string, error) {
+	repoURL, err := githubAPIRepoURL(giturl)
+	if err != nil {
+		return "", err
+	}
+	var release githubrelease
+	if err := httpLoadJSON(g.client, repoURL+"/releases/tags/"+url.PathEscape(tag), &release); err != nil {
+		return "", err
+	}
+	return release.Body, nil
+}
+
+func (g restGithub) updatePullRequestBody(pr int, body string) error {
+	return httpSendJSON(g.client, "PATCH", g.lib.apiURL("/pulls/%d", pr), map[string]interface{}{"body": body})
+}
+
+// createCheckRun reports the run as a check run, only GitHub Apps can create those,
+// with basic auth its conclusion is reported as a commit status of the head commit instead.
+func (g restGithub) createCheckRun(run checkRun) error {
+	if _, ok := g.client.auth.(*appAuth); !ok {
+		return httpSendJSON(g.client, "POST", g.lib.apiURL("/statuses/%s", run.HeadSHA), newCommitStatus(run))
+	}
+	return httpSendJSON(g.client, "POST", g.lib.apiURL("/check-runs"), run)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// appJWTLifetime is below GitHub's 10 minutes maximum, iat is backdated to allow some clock drift.
+	appJWTLifetime  = 9 * time.Minute
+	appJWTClockSkew = time.Minute
+	// appTokenRefreshMargin renews the installation token before it expires, tokens are valid for an hour.
+	appTokenRefreshMargin = 5 * time.Minute
+)
+
+type githubAuth interface {
+	authorize(req *http.Request) error
+}
+
+type basicAuth struct {
+	user  string
+	token string
+}
+
+func (a basicAuth) authorize(req *http.Request) error {
+	if a.token != "" {
+		req.SetBasicAuth(a.user, a.token)
+	}
+	return nil
+}
+
+// appAuth authenticates as a GitHub App installation, the installation token is cached until it is about to expire.
+type appAuth struct {
+	appID          string
+	installationID string
+	key            *rsa.PrivateKey
+	client         *http.Client
+	fallback       githubAuth
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+type installationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// githubCredentials configure how a steplib's GitHub calls authenticate and how its webhooks are verified.
+type githubCredentials struct {
+	AppID          string `yaml:"app_id"`
+	InstallationID string `yaml:"installation_id"`
+	PrivateKey     string `yaml:"private_key"`
+	PrivateKeyPath string `yaml:"private_key_path"`
+	User           string `yaml:"user"`
+	AccessToken    string `yaml:"access_token"`
+	// WebhookSecrets holds several secrets while one is being rotated.
+	WebhookSecrets []string `yaml:"webhook_secrets"`
+}
+
+func githubCredentialsFromEnv() githubCredentials {
+	return githubCredentials{
+		AppID:          os.Getenv("GITHUB_APP_ID"),
+		InstallationID: os.Getenv("GITHUB_APP_INSTALLATION_ID"),
+		PrivateKey:     os.Getenv("GITHUB_APP_PRIVATE_KEY"),
+		PrivateKeyPath: os.Getenv("GITHUB_APP_PRIVATE_KEY_PATH"),
+		User:           os.Getenv("GITHUB_USER"),
+		AccessToken:    os.Getenv("GITHUB_ACCESS_TOKEN"),
+		WebhookSecrets: webhookSecrets(),
+	}
+}
+
+// withDefaults fills the unset app and basic auth credentials and webhook secrets from defaults, as groups.
+func (c githubCredentials) withDefaults(defaults githubCredentials) githubCredentials {
+	if c.AppID == "" {
+		c.AppID, c.InstallationID, c.PrivateKey, c.PrivateKeyPath = defaults.AppID, defaults.InstallationID, defaults.PrivateKey, defaults.PrivateKeyPath
+	}
+	if c.AccessToken == "" {
+		c.User, c.AccessToken = defaults.User, defaults.AccessToken
+	}
+	if len(c.WebhookSecrets) == 0 {
+		c.WebhookSecrets = defaults.WebhookSecrets
+	}
+	return c
+}
+
+// newGithubAuth uses GitHub App auth if the app is configured, basic auth with the user and access token otherwise.
+func newGithubAuth(creds githubCredentials) githubAuth {
+	fallback := basicAuth{user: creds.User, token: creds.AccessToken}
+
+	if creds.AppID == "" {
+		return fallback
+	}
+
+	key, err := loadAppPrivateKey(creds)
+	if err != nil {
+		logger.withError(err).warnf("failed to load GitHub App private key, falling back to basic auth")
+		return fallback
+	}
+
+	if creds.InstallationID == "" {
+		logger.warnf("GitHub App installation ID is not set, falling back to basic auth")
+		return fallback
+	}
+
+	return &appAuth{
+		appID:          creds.AppID,
+		installationID: creds.InstallationID,
+		key:            key,
+		client:         &http.Client{Timeout: 30 * time.Second, Transport: httpTransport},
+		fallback:       fallback,
+	}
+}
+
+// loadAppPrivateKey reads the PEM key from the credentials, or from the file at their private key path.
+func loadAppPrivateKey(creds githubCredentials) (*rsa.PrivateKey, error) {
+	keyPEM := []byte(creds.PrivateKey)
+	if len(keyPEM) == 0 {
+		if creds.PrivateKeyPath == "" {
+			return nil, fmt.Errorf("neither private key nor private key path is set")
+		}
+
+		b, err := ioutil.ReadFile(creds.PrivateKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM = b
+	}
+
+	return parseRSAPrivateKey(keyPEM)
+}
+
+func parseRSAPrivateKey(keyPEM []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+	return key, nil
+}
+
+// appJWT signs the RS256 JWT the app authenticates with when requesting installation tokens.
+func appJWT(appID string, key *rsa.PrivateKey, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-appJWTClockSkew).Unix(),
+		"exp": now.Add(appJWTLifetime).Unix(),
+		"iss": appID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// installationToken returns the cached installation token, or exchanges a new JWT for one if it is about to expire.
+func (a *appAuth) installationToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token != "" && time.Now().Add(appTokenRefreshMargin).Before(a.expiresAt) {
+		return a.token, nil
+	}
+
+	jwt, err := appJWT(a.appID, a.key, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("https://api.github.com/app/installations/%s/access_tokens", a.installationID), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github.machine-man-preview+json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.withError(err).warnf("failed to close body")
+		}
+	}()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("Invalid response code: %d from: %s, body: %s", resp.StatusCode, req.URL, strings.TrimSpace(string(b)))
+	}
+
+	var token installationToken
+	if err := json.Unmarshal(b, &token); err != nil {
+		return "", err
+	}
+
+	a.token, a.expiresAt = token.Token, token.ExpiresAt
+
+	return a.token, nil
+}
+
+func (a *appAuth) authorize(req *http.Request) error {
+	token, err := a.installationToken()
+	if err != nil {
+		logger.withError(err).warnf("failed to get GitHub App installation token, falling back to basic auth")
+		return a.fallback.authorize(req)
+	}
+
+	req.Header.Set("Authorization", "token "+token)
+	return nil
+}
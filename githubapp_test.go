@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+func testAppKey(t *testing.T) *rsa.PrivateKey {
+	testKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testKey = key
+	})
+	return testKey
+}
+
+// verifyAppJWT checks the RS256 signature of the JWT and returns its header and claims.
+func verifyAppJWT(t *testing.T, jwt string, key *rsa.PublicKey) (header map[string]string, claims map[string]interface{}) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("JWT has %d parts", len(parts))
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		t.Fatalf("invalid signature: %s", err)
+	}
+
+	for i, v := range []interface{}{&header, &claims} {
+		b, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(b, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return header, claims
+}
+
+func TestAppJWT(t *testing.T) {
+	key := testAppKey(t)
+	now := time.Unix(1700000000, 0)
+
+	jwt, err := appJWT("12345", key, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, claims := verifyAppJWT(t, jwt, &key.PublicKey)
+
+	if header["alg"] != "RS256" || header["typ"] != "JWT" {
+		t.Errorf("header = %v", header)
+	}
+	iat, exp := int64(claims["iat"].(float64)), int64(claims["exp"].(float64))
+	if iat != now.Unix()-60 {
+		t.Errorf("iat = %d, want backdated by a minute to %d", iat, now.Unix()-60)
+	}
+	if exp <= now.Unix() || exp-iat > 600 {
+		t.Errorf("exp = %d, want in the future and at most 10 minutes after iat %d", exp, iat)
+	}
+	if claims["iss"] != "12345" {
+		t.Errorf("iss = %v", claims["iss"])
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(jwt, ".")
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(&other.PublicKey, crypto.SHA256, digest[:], signature) == nil {
+		t.Error("signature verifies with another key")
+	}
+}
+
+// tokenServer is the installation token endpoint of GitHub, every token it issues expires after lifetime.
+type tokenServer struct {
+	t        *testing.T
+	key      *rsa.PublicKey
+	lifetime time.Duration
+	status   int
+
+	mu     sync.Mutex
+	issued int
+}
+
+func (s *tokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.URL.Path != "/app/installations/42/access_tokens" {
+		s.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+	}
+	_, claims := verifyAppJWT(s.t, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), s.key)
+	if claims["iss"] != "12345" {
+		s.t.Errorf("iss = %v", claims["iss"])
+	}
+
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+
+	s.mu.Lock()
+	s.issued++
+	token := fmt.Sprintf("token-%d", s.issued)
+	s.mu.Unlock()
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"token": token, "expires_at": time.Now().Add(s.lifetime)}); err != nil {
+		s.t.Error(err)
+	}
+}
+
+func newTestAppAuth(t *testing.T, server *httptest.Server) *appAuth {
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &appAuth{
+		appID:          "12345",
+		installationID: "42",
+		key:            testAppKey(t),
+		client:         &http.Client{Transport: redirectTransport{target: target}},
+		fallback:       basicAuth{user: "bot", token: "pat"},
+	}
+}
+
+func TestAppAuthCachesInstallationToken(t *testing.T) {
+	tokens := &tokenServer{t: t, key: &testAppKey(t).PublicKey, lifetime: time.Hour}
+	server := httptest.NewServer(tokens)
+	defer server.Close()
+	auth := newTestAppAuth(t, server)
+
+	for i := 0; i < 3; i++ {
+		token, err := auth.installationToken()
+		if err != nil || token != "token-1" {
+			t.Fatalf("installationToken = %q, %v, want the cached token-1", token, err)
+		}
+	}
+
+	// about to expire: renewed before GitHub would reject it
+	auth.expiresAt = time.Now().Add(appTokenRefreshMargin - time.Second)
+	req := httptest.NewRequest("GET", "https://api.github.com/rate_limit", nil)
+	if err := auth.authorize(req); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("Authorization"); got != "token token-2" {
+		t.Errorf("Authorization = %q, want the renewed token-2", got)
+	}
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	if tokens.issued != 2 {
+		t.Errorf("%d tokens issued, want 2", tokens.issued)
+	}
+}
+
+func TestAppAuthFallsBackToBasicAuth(t *testing.T) {
+	server := httptest.NewServer(&tokenServer{t: t, key: &testAppKey(t).PublicKey, status: http.StatusUnauthorized})
+	defer server.Close()
+
+	req := httptest.NewRequest("GET", "https://api.github.com/rate_limit", nil)
+	if err := newTestAppAuth(t, server).authorize(req); err != nil {
+		t.Fatal(err)
+	}
+	if user, token, ok := req.BasicAuth(); !ok || user != "bot" || token != "pat" {
+		t.Errorf("Authorization = %q, want the basic auth fallback", req.Header.Get("Authorization"))
+	}
+}
+
+func TestLoadAppPrivateKey(t *testing.T) {
+	key := testAppKey(t)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs1PEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	pkcs8PEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})
+
+	dir, err := ioutil.TempDir("", "appkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	path := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(path, pkcs8PEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, creds := range map[string]githubCredentials{
+		"PKCS#1":   {PrivateKey: string(pkcs1PEM)},
+		"PKCS#8":   {PrivateKey: string(pkcs8PEM)},
+		"key path": {PrivateKeyPath: path},
+	} {
+		loaded, err := loadAppPrivateKey(creds)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if loaded.N.Cmp(key.N) != 0 {
+			t.Errorf("%s: loaded another key", name)
+		}
+	}
+
+	for name, creds := range map[string]githubCredentials{
+		"no key":   {},
+		"not PEM":  {PrivateKey: "secret"},
+		"bad path": {PrivateKeyPath: filepath.Join(dir, "missing.pem")},
+	} {
+		if _, err := loadAppPrivateKey(creds); err == nil {
+			t.Errorf("%s: loaded a key", name)
+		}
+	}
+}
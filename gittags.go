@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tagBackendAuto   = "auto"
+	tagBackendGithub = "github"
+	tagBackendGit    = "git"
+
+	gitTimeout = time.Minute
+	// defaultGitProtocols are the transports git may use for the source URLs, which come from the PRs.
+	// ext:: and the like would run commands, file:// would read the server's disk.
+	defaultGitProtocols = "https"
+	// defaultGitCacheRepos is how many remotes GIT_CACHE_DIR keeps, the least recently used ones are removed
+	defaultGitCacheRepos = 100
+)
+
+// defaultGitHosts are the hosts the git backend connects to if GIT_ALLOWED_HOSTS is not set.
+var defaultGitHosts = []string{"github.com", "gitlab.com", "bitbucket.org"}
+
+// gitHostCheck rejects the sources of the hosts git must not connect to, the tests replace it to use file:// sources.
+var gitHostCheck = checkGitHost
+
+var (
+	// gitCacheMu guards gitCacheLocks and the creation and eviction of the cache repositories, it is never held
+	// during a fetch, so a slow remote does not hold up the others.
+	gitCacheMu sync.Mutex
+	// gitCacheLocks serialize the fetches into the same cache repository, by its directory.
+	gitCacheLocks = map[string]*gitCacheLock{}
+)
+
+// gitCacheLock is the lock of a cache repository, users counts the ones holding or waiting for it,
+// evictGitCache leaves the repository alone while it has any.
+type gitCacheLock struct {
+	sync.Mutex
+	users int
+}
+
+// resolveGitTag resolves the tag with git itself, so it works for any git host: ls-remote tells whether the tag exists,
+// then the tag is fetched into a bare repository cache to dereference annotated tags and to learn the object type.
+// The source URLs come from the PRs, so only the hosts of GIT_ALLOWED_HOSTS are connected to.
+func resolveGitTag(giturl, tag string) (target tagTarget, found bool, err error) {
+	if strings.HasPrefix(giturl, "-") {
+		return tagTarget{}, false, fmt.Errorf("invalid git URL: %s", giturl)
+	}
+	if err := gitHostCheck(giturl); err != nil {
+		return tagTarget{}, false, err
+	}
+
+	ref := "refs/tags/" + tag
+	out, err := runGit("", "ls-remote", "--tags", giturl, ref)
+	if err != nil {
+		return tagTarget{}, false, err
+	}
+
+	sha := ""
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == ref {
+			sha = fields[0]
+		}
+	}
+	if sha == "" {
+		return tagTarget{}, false, nil
+	}
+
+	dir, release, err := lockGitCacheRepo(giturl)
+	if err != nil {
+		return tagTarget{}, false, err
+	}
+	defer release()
+
+	if _, err := runGit(dir, "cat-file", "-e", sha); err != nil {
+		if _, err := runGit(dir, "fetch", "--quiet", "--no-tags", "--depth=1", giturl, "+"+ref+":"+ref); err != nil {
+			return tagTarget{}, false, err
+		}
+	}
+
+	for depth := 0; ; depth++ {
+		objectType, err := runGit(dir, "cat-file", "-t", sha)
+		if err != nil {
+			return tagTarget{}, false, err
+		}
+		objectType = strings.TrimSpace(objectType)
+
+		if objectType != "tag" {
+			target.SHA, target.Type = sha, objectType
+			return target, true, nil
+		}
+
+		if depth == maxTagDepth {
+			return tagTarget{}, false, fmt.Errorf("tag %s is nested deeper than %d annotated tags", tag, maxTagDepth)
+		}
+		target.TagObjects = append(target.TagObjects, sha)
+
+		if sha, err = taggedObject(dir, sha); err != nil {
+			return tagTarget{}, false, err
+		}
+	}
+}
+
+// taggedObject reads the object line of the annotated tag object.
+func taggedObject(dir, sha string) (string, error) {
+	out, err := runGit(dir, "cat-file", "tag", sha)
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "object ") {
+			return strings.TrimPrefix(line, "object "), nil
+		}
+	}
+	return "", fmt.Errorf("annotated tag object %s has no object", sha)
+}
+
+// checkGitHost rejects the URL unless its host is in GIT_ALLOWED_HOSTS, or one of defaultGitHosts if it is not set.
+// Any other host could be an internal service the server can reach, but the PR authors should not.
+func checkGitHost(giturl string) error {
+	allowed := splitList(os.Getenv("GIT_ALLOWED_HOSTS"))
+	if len(allowed) == 0 {
+		allowed = defaultGitHosts
+	}
+
+	u, err := url.Parse(giturl)
+	if err == nil {
+		for _, host := range allowed {
+			if u.Hostname() != "" && strings.EqualFold(u.Hostname(), host) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("git host of %s is not allowed", giturl)
+}
+
+// lockGitCacheRepo returns the cache repository of the remote locked, release unlocks it.
+func lockGitCacheRepo(giturl string) (dir string, release func(), err error) {
+	gitCacheMu.Lock()
+	dir, err = gitCacheRepo(giturl)
+	if err != nil {
+		gitCacheMu.Unlock()
+		return "", nil, err
+	}
+
+	lock, ok := gitCacheLocks[dir]
+	if !ok {
+		lock = &gitCacheLock{}
+		gitCacheLocks[dir] = lock
+	}
+	lock.users++
+	gitCacheMu.Unlock()
+
+	lock.Lock()
+	return dir, func() {
+		lock.Unlock()
+
+		gitCacheMu.Lock()
+		defer gitCacheMu.Unlock()
+		if lock.users--; lock.users == 0 {
+			delete(gitCacheLocks, dir)
+		}
+	}, nil
+}
+
+// gitCacheRepo returns the bare repository caching the fetched tags of the remote, in GIT_CACHE_DIR.
+// Its modification time is bumped on every use, so evictGitCache knows which ones were used last.
+// The caller holds gitCacheMu.
+func gitCacheRepo(giturl string) (string, error) {
+	root := os.Getenv("GIT_CACHE_DIR")
+	if root == "" {
+		root = filepath.Join(os.TempDir(), "steplib-git-check")
+	}
+
+	dir := filepath.Join(root, fmt.Sprintf("%x", sha1.Sum([]byte(giturl))))
+	if _, err := os.Stat(filepath.Join(dir, "HEAD")); err == nil {
+		now := time.Now()
+		return dir, os.Chtimes(dir, now, now)
+	}
+
+	if err := evictGitCache(root, gitCacheReposFromEnv()-1); err != nil {
+		logger.withError(err).warnf("failed to evict git cache")
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if _, err := runGit(dir, "init", "--quiet", "--bare"); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// gitCacheReposFromEnv is GIT_CACHE_REPOS, the number of remotes kept in the cache.
+func gitCacheReposFromEnv() int {
+	n, err := strconv.Atoi(os.Getenv("GIT_CACHE_REPOS"))
+	if err != nil || n <= 0 {
+		return defaultGitCacheRepos
+	}
+	return n
+}
+
+// evictGitCache removes the least recently used repositories of the cache until at most keep are left,
+// except the ones in use. The caller holds gitCacheMu.
+func evictGitCache(root string, keep int) error {
+	entries, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var repos []os.FileInfo
+	for _, entry := range entries {
+		if entry.IsDir() {
+			repos = append(repos, entry)
+		}
+	}
+	if len(repos) <= keep {
+		return nil
+	}
+
+	sort.Slice(repos, func(i, j int) bool {
+		return repos[i].ModTime().Before(repos[j].ModTime())
+	})
+	for _, repo := range repos[:len(repos)-keep] {
+		dir := filepath.Join(root, repo.Name())
+		if _, inUse := gitCacheLocks[dir]; inUse {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runGit runs git in dir without prompting, restricted to the protocols of GIT_ALLOW_PROTOCOL (https by default).
+func runGit(dir string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	// a redirect could lead to a host GIT_ALLOWED_HOSTS does not allow
+	args = append([]string{"-c", "http.followRedirects=false"}, args...)
+	cmd := exec.CommandContext(ctx, "git", args...)
+
+	protocols := os.Getenv("GIT_ALLOW_PROTOCOL")
+	if protocols == "" {
+		protocols = defaultGitProtocols
+	}
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ALLOW_PROTOCOL="+protocols)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %s, %s", strings.Join(args, " "), err, redactText(strings.TrimSpace(stderr.String())))
+	}
+	return string(out), nil
+}
+
+// usesGitTags tells whether the tags of the source are resolved with git or with the GitHub API:
+// the auto backend uses the API for github.com sources and git for every other host.
+func (l *steplib) usesGitTags(giturl string) bool {
+	switch l.TagBackend {
+	case tagBackendGit:
+		return true
+	case tagBackendGithub:
+		return false
+	default:
+		return !strings.HasPrefix(giturl, "https://github.com/")
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gitTestEnv points the git backend at a temp cache and allows file:// sources.
+func gitTestEnv(t *testing.T) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir := t.TempDir()
+	for key, value := range map[string]string{"GIT_ALLOW_PROTOCOL": "file", "GIT_CACHE_DIR": filepath.Join(dir, "cache"), "GIT_ALLOWED_HOSTS": "", "GIT_CACHE_REPOS": ""} {
+		t.Setenv(key, value)
+	}
+
+	gitHostCheck = func(giturl string) error {
+		if strings.HasPrefix(giturl, "file://") {
+			return nil
+		}
+		return checkGitHost(giturl)
+	}
+	t.Cleanup(func() { gitHostCheck = checkGitHost })
+
+	return dir
+}
+
+func git(t *testing.T, dir string, args ...string) string {
+	args = append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "tag.gpgSign=false", "-c", "commit.gpgSign=false"}, args...)
+	out, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s, %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// newSourceRepo creates a repository with a lightweight, an annotated, a nested annotated and a tree tag.
+func newSourceRepo(t *testing.T, root string) (giturl string, commit string) {
+	dir := filepath.Join(root, "source")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	git(t, dir, "init", "--quiet")
+	git(t, dir, "commit", "--quiet", "--allow-empty", "-m", "initial")
+	commit = git(t, dir, "rev-parse", "HEAD")
+
+	git(t, dir, "tag", "1.0.0")
+	git(t, dir, "tag", "-a", "-m", "release", "1.1.0")
+	git(t, dir, "tag", "-a", "-m", "nested", "1.2.0", "1.1.0")
+	git(t, dir, "tag", "2.0.0", "HEAD^{tree}")
+
+	return "file://" + dir, commit
+}
+
+func TestResolveGitTag(t *testing.T) {
+	root := gitTestEnv(t)
+	giturl, commit := newSourceRepo(t, root)
+	tree := git(t, filepath.Join(root, "source"), "rev-parse", "HEAD^{tree}")
+
+	for _, tc := range []struct {
+		tag        string
+		found      bool
+		sha        string
+		objectType string
+		tagObjects int
+	}{
+		{tag: "1.0.0", found: true, sha: commit, objectType: "commit"},
+		{tag: "1.1.0", found: true, sha: commit, objectType: "commit", tagObjects: 1},
+		{tag: "1.2.0", found: true, sha: commit, objectType: "commit", tagObjects: 2},
+		{tag: "2.0.0", found: true, sha: tree, objectType: "tree"},
+		{tag: "3.0.0"},
+	} {
+		t.Run(tc.tag, func(t *testing.T) {
+			target, found, err := resolveGitTag(giturl, tc.tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != tc.found {
+				t.Fatalf("found = %v, want %v", found, tc.found)
+			}
+			if target.SHA != tc.sha || target.Type != tc.objectType || len(target.TagObjects) != tc.tagObjects {
+				t.Errorf("target = %+v, want %s %s via %d tag objects", target, tc.objectType, tc.sha, tc.tagObjects)
+			}
+		})
+	}
+}
+
+func TestResolveGitTagRejectsSources(t *testing.T) {
+	root := gitTestEnv(t)
+	giturl, _ := newSourceRepo(t, root)
+
+	if _, _, err := resolveGitTag("--upload-pack=false", "1.0.0"); err == nil {
+		t.Error("option-like URL accepted")
+	}
+
+	t.Setenv("GIT_ALLOW_PROTOCOL", "")
+	if _, _, err := resolveGitTag(giturl, "1.0.0"); err == nil {
+		t.Error("file:// source accepted with the default protocols")
+	}
+
+	gitHostCheck = checkGitHost
+	if _, _, err := resolveGitTag("https://169.254.169.254/latest/meta-data.git", "1.0.0"); err == nil || !strings.Contains(err.Error(), "is not allowed") {
+		t.Errorf("err = %v, want the host to be rejected before connecting", err)
+	}
+}
+
+func TestCheckGitHost(t *testing.T) {
+	for _, tc := range []struct {
+		allowedHosts string
+		giturl       string
+		allowed      bool
+	}{
+		{"", "https://github.com/bitrise-steplib/steps-script.git", true},
+		{"", "https://GitHub.com/bitrise-steplib/steps-script.git", true},
+		{"", "https://gitlab.com/owner/repo.git", true},
+		{"", "https://bitbucket.org/owner/repo.git", true},
+		{"", "https://internal.example/repo.git", false},
+		{"", "http://169.254.169.254/latest/meta-data", false},
+		{"", "https://localhost:8080/repo.git", false},
+		{"", "https://github.com.evil.example/repo.git", false},
+		{"", "file:///tmp/repo", false},
+		{"", "git@github.com:owner/repo.git", false},
+		{"git.example.com, github.com", "https://git.example.com/owner/repo.git", true},
+		{"git.example.com, github.com", "https://github.com/owner/repo.git", true},
+		{"git.example.com, github.com", "https://gitlab.com/owner/repo.git", false},
+	} {
+		t.Run(tc.allowedHosts+" "+tc.giturl, func(t *testing.T) {
+			t.Setenv("GIT_ALLOWED_HOSTS", tc.allowedHosts)
+
+			if err := checkGitHost(tc.giturl); (err == nil) != tc.allowed {
+				t.Errorf("allowed = %v, want %v (err: %v)", err == nil, tc.allowed, err)
+			}
+		})
+	}
+}
+
+func TestGitCacheLocksPerRepository(t *testing.T) {
+	gitTestEnv(t)
+
+	dirA, releaseA, err := lockGitCacheRepo("file:///a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a fetch in progress in one repository does not hold up the others
+	locked := make(chan func())
+	go func() {
+		_, releaseB, err := lockGitCacheRepo("file:///b")
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- releaseB
+	}()
+	select {
+	case releaseB := <-locked:
+		releaseB()
+	case <-time.After(5 * time.Second):
+		t.Fatal("repository b is blocked by the lock of repository a")
+	}
+
+	// the repository in use is kept, even if it is the least recently used one
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(dirA, past, past); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GIT_CACHE_REPOS", "1")
+	if _, err := gitCacheRepo("file:///c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dirA); err != nil {
+		t.Errorf("repository in use was evicted: %s", err)
+	}
+
+	releaseA()
+	if len(gitCacheLocks) != 0 {
+		t.Errorf("%d locks left after release", len(gitCacheLocks))
+	}
+}
+
+func TestGitCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	root := gitTestEnv(t)
+	t.Setenv("GIT_CACHE_REPOS", "2")
+
+	dirs := map[string]string{}
+	for i, source := range []string{"file:///a", "file:///b", "file:///a", "file:///c"} {
+		dir, err := gitCacheRepo(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs[source] = dir
+
+		// modification times have a coarse resolution on some filesystems
+		past := time.Now().Add(time.Duration(i-10) * time.Minute)
+		if err := os.Chtimes(dir, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(root, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("cache has %d repositories, want 2", len(entries))
+	}
+	for source, kept := range map[string]bool{"file:///a": true, "file:///b": false, "file:///c": true} {
+		if _, err := os.Stat(dirs[source]); (err == nil) != kept {
+			t.Errorf("repository of %s kept = %v, want %v", source, err == nil, kept)
+		}
+	}
+}
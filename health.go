@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// readinessTTL limits how often the readiness probe reaches out to GitHub.
+	readinessTTL = 15 * time.Second
+	// unauthenticatedRateLimit is the hourly limit GitHub applies to the requests without valid credentials.
+	unauthenticatedRateLimit = 60
+)
+
+type readiness struct {
+	mu       sync.Mutex
+	checked  time.Time
+	failures map[string]string
+}
+
+type healthStatus struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func (s *server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, healthStatus{Status: "ok"})
+}
+
+// readyzHandler reports whether the server can take traffic: it is not shutting down
+// and every steplib can reach GitHub with valid credentials.
+func (s *server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if s.isDraining() {
+		respondWithJSON(w, http.StatusServiceUnavailable, healthStatus{Status: "shutting down"})
+		return
+	}
+
+	failures := s.ready.check(s.steplibs)
+	if len(failures) > 0 {
+		respondWithJSON(w, http.StatusServiceUnavailable, healthStatus{Status: "unavailable", Checks: failures})
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, healthStatus{Status: "ok"})
+}
+
+// check returns the failing steplibs with the reason, the result is reused for readinessTTL.
+func (r *readiness) check(steplibs *steplibRegistry) map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) < readinessTTL {
+		return r.failures
+	}
+
+	failures := map[string]string{}
+	for name, lib := range steplibs.byName {
+		if err := checkGithubAccess(lib.client); err != nil {
+			failures[name] = err.Error()
+		}
+	}
+
+	r.checked, r.failures = time.Now(), failures
+	return failures
+}
+
+// checkGithubAccess calls the rate limit endpoint, which does not count against the limit,
+// and fails if GitHub is unreachable or the credentials are missing or rejected.
+func checkGithubAccess(c *githubClient) error {
+	resp, err := c.roundTripWithAuth("GET", "https://api.github.com/rate_limit")
+	if err != nil {
+		return fmt.Errorf("GitHub is unreachable: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GitHub responded with %d, the credentials might be invalid", resp.StatusCode)
+	}
+
+	if limit, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Limit")); err == nil && limit <= unauthenticatedRateLimit {
+		return fmt.Errorf("GitHub requests are not authenticated")
+	}
+
+	return nil
+}
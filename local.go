@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// localSteplib is the githubAPI of a local steplib checkout, the changes of the diff range stand in for the PR files.
+// The tags of the step repositories are still resolved remotely by tags.
+type localSteplib struct {
+	dir string
+	// base is the revision the existing step versions are listed at, head is the one the step.yml files are read at,
+	// the working tree if empty.
+	base string
+	head string
+	tags githubAPI
+}
+
+// newLocalSteplib resolves the diff range: base..head, base...head (from their merge base) or a single base
+// compared to the working tree.
+func newLocalSteplib(dir, diffRange string, tags githubAPI) (*localSteplib, error) {
+	l := &localSteplib{dir: dir, tags: tags}
+
+	switch {
+	case strings.Contains(diffRange, "..."):
+		parts := strings.SplitN(diffRange, "...", 2)
+		l.head = defaultRev(parts[1])
+		base, err := l.git("merge-base", defaultRev(parts[0]), l.head)
+		if err != nil {
+			return nil, err
+		}
+		l.base = strings.TrimSpace(base)
+	case strings.Contains(diffRange, ".."):
+		parts := strings.SplitN(diffRange, "..", 2)
+		l.base, l.head = defaultRev(parts[0]), defaultRev(parts[1])
+	default:
+		l.base = defaultRev(diffRange)
+	}
+
+	return l, nil
+}
+
+func defaultRev(rev string) string {
+	if rev == "" {
+		return "HEAD"
+	}
+	return rev
+}
+
+func (l *localSteplib) git(args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", l.dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %s, %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+func (l *localSteplib) pullRequest(pr int) (content, error) {
+	return content{}, fmt.Errorf("a local steplib has no pull requests")
+}
+
+// pullRequestFiles lists the files changed in the diff range, renamed files are listed by their new name.
+func (l *localSteplib) pullRequestFiles(pr int) ([]file, error) {
+	args := []string{"diff", "--name-status", "-M", l.base}
+	if l.head != "" {
+		args = append(args, l.head)
+	}
+
+	out, err := l.git(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []file
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 {
+			continue
+		}
+
+		status := "modified"
+		switch fields[0][0] {
+		case 'A', 'C':
+			status = "added"
+		case 'D':
+			status = "removed"
+		case 'R':
+			status = "renamed"
+		}
+
+		name := fields[len(fields)-1]
+		files = append(files, file{Filename: name, Status: status})
+	}
+
+	return files, nil
+}
+
+// fileContent reads the file at the ref, the head revision of the diff range if the ref is empty.
+func (l *localSteplib) fileContent(path, ref string) ([]byte, error) {
+	if ref == "" {
+		ref = l.head
+	}
+	if ref == "" {
+		return ioutil.ReadFile(filepath.Join(l.dir, path))
+	}
+
+	out, err := l.git("show", ref+":"+path)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(out), nil
+}
+
+// contents lists the directory at the base revision, where the released step versions are.
+func (l *localSteplib) contents(path string) ([]contentEntry, bool, error) {
+	object := l.base + ":" + strings.TrimSuffix(path, "/")
+	if _, err := l.git("cat-file", "-e", object); err != nil {
+		return nil, false, nil
+	}
+
+	out, err := l.git("ls-tree", object)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var entries []contentEntry
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		// <mode> SP <type> SP <object> TAB <name>
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+
+		entryType := "file"
+		if strings.Contains(fields[0], " tree ") {
+			entryType = "dir"
+		}
+		entries = append(entries, contentEntry{Name: fields[1], Type: entryType})
+	}
+
+	return entries, true, nil
+}
+
+func (l *localSteplib) tag(giturl, tag string) (tagTarget, bool, error) {
+	return l.tags.tag(giturl, tag)
+}
+
+func (l *localSteplib) releaseBody(giturl, tag string) (string, error) {
+	return "", fmt.Errorf("release announcements are not supported for a local steplib")
+}
+
+func (l *localSteplib) updatePullRequestBody(pr int, body string) error {
+	return fmt.Errorf("a local steplib has no pull requests")
+}
+
+func (l *localSteplib) createCheckRun(run checkRun) error {
+	return fmt.Errorf("a local steplib has no check runs")
+}
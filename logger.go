@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+// secretPatterns match credentials which can end up in messages, in URLs or error texts for example.
+var secretPatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`(?i)((?:api_key|access_token|token|secret|password|client_secret)=)[^&\s"]+`), "${1}[REDACTED]"},
+	{regexp.MustCompile(`(?i)((?:bearer|token|basic)\s+)[A-Za-z0-9._~+/=-]{16,}`), "${1}[REDACTED]"},
+	{regexp.MustCompile(`github_pat_[A-Za-z0-9_]{20,}`), "[REDACTED]"},
+	{regexp.MustCompile(`gh[pousr]_[A-Za-z0-9]{20,}`), "[REDACTED]"},
+	{regexp.MustCompile(`(https?://)[^/\s:@]+:[^/\s@]+@`), "${1}[REDACTED]@"},
+}
+
+// logger writes one JSON object per line, carrying the fields of the context the message belongs to:
+// delivery, repo, pr, step and version.
+var logger = newLoggerFromEnv(os.Stdout)
+
+type jsonLogger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  logLevel
+	fields map[string]interface{}
+}
+
+// newLoggerFromEnv logs at LOG_LEVEL (debug, info, warn or error), info by default.
+func newLoggerFromEnv(out io.Writer) *jsonLogger {
+	level := levelInfo
+	for l, name := range levelNames {
+		if strings.EqualFold(os.Getenv("LOG_LEVEL"), name) {
+			level = l
+		}
+	}
+
+	return &jsonLogger{mu: &sync.Mutex{}, out: out, level: level, fields: map[string]interface{}{}}
+}
+
+// with returns a logger adding the field to every message, empty values are left out.
+func (l *jsonLogger) with(key string, value interface{}) *jsonLogger {
+	if value == "" || value == nil {
+		return l
+	}
+
+	fields := make(map[string]interface{}, len(l.fields)+1)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+
+	return &jsonLogger{mu: l.mu, out: l.out, level: l.level, fields: fields}
+}
+
+func (l *jsonLogger) withError(err error) *jsonLogger {
+	if err == nil {
+		return l
+	}
+	return l.with("error", err.Error())
+}
+
+// forPR is the logger of a pull_request event.
+func (l *jsonLogger) forPR(lib *steplib, pr pullRequestModel) *jsonLogger {
+	return l.with("delivery", pr.DeliveryID).with("repo", lib.fullName()).with("pr", pr.Number).with("action", pr.Action)
+}
+
+// forStep adds the step and its version to the logger.
+func (l *jsonLogger) forStep(stepID, version string) *jsonLogger {
+	return l.with("step", stepID).with("version", version)
+}
+
+func (l *jsonLogger) debugf(format string, args ...interface{}) { l.log(levelDebug, format, args...) }
+func (l *jsonLogger) infof(format string, args ...interface{})  { l.log(levelInfo, format, args...) }
+func (l *jsonLogger) warnf(format string, args ...interface{})  { l.log(levelWarn, format, args...) }
+func (l *jsonLogger) errorf(format string, args ...interface{}) { l.log(levelError, format, args...) }
+
+func (l *jsonLogger) log(level logLevel, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+
+	entry := make(map[string]interface{}, len(l.fields)+3)
+	for key, value := range l.fields {
+		if isRedactedKey(key) {
+			value = "[REDACTED]"
+		} else if s, ok := value.(string); ok {
+			value = redactText(s)
+		}
+		entry[key] = value
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = levelNames[level]
+	entry["msg"] = redactText(fmt.Sprintf(format, args...))
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b = []byte(fmt.Sprintf(`{"level":"error","msg":"failed to encode log entry: %s"}`, err))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.out.Write(append(b, '\n')); err != nil {
+		fmt.Fprintln(os.Stderr, "failed to write log entry:", err)
+	}
+}
+
+func redactText(s string) string {
+	for _, secret := range secretPatterns {
+		s = secret.pattern.ReplaceAllString(s, secret.replacement)
+	}
+	return s
+}
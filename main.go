@@ -1,210 +1,290 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
-	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gobuffalo/envy"
 	"github.com/gorilla/mux"
 )
 
+const (
+	serverReadTimeout  = 10 * time.Second
+	serverWriteTimeout = time.Minute
+	serverIdleTimeout  = 2 * time.Minute
+	// defaultShutdownTimeout fits in the 30 seconds Heroku waits after SIGTERM before killing the dyno.
+	defaultShutdownTimeout = 25 * time.Second
+)
+
+type server struct {
+	steplibs *steplibRegistry
+	jobs     *jobQueue
+	ready    readiness
+	draining int32
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	steplibs, err := loadConfig()
+	if err != nil {
+		logger.withError(err).errorf("invalid config")
+		os.Exit(1)
+	}
+	if db, err = openStoreFromEnv(steplibs); err != nil {
+		logger.withError(err).errorf("failed to open store")
+		os.Exit(1)
+	}
+	if failed, err := failInterruptedDeliveries(); err != nil {
+		logger.withError(err).errorf("failed to fail the interrupted deliveries")
+	} else if failed > 0 {
+		logger.with("deliveries", failed).warnf("marked the deliveries interrupted by the last restart failed")
+	}
+	if err := pruneDeliveries(time.Now()); err != nil {
+		logger.withError(err).errorf("failed to prune deliveries")
+	}
+	go pruneDeliveriesPeriodically()
+
+	s := &server{steplibs: steplibs, jobs: newJobQueueFromEnv(runPullRequestJob)}
+
 	router := mux.NewRouter()
 
 	////
 	// handlers
 	//
 
-	router.HandleFunc("/tag", tagHandler).Methods("GET")
-	router.HandleFunc("/update", updateHandler).Methods("POST")
+	router.HandleFunc("/healthz", s.healthzHandler).Methods("GET")
+	router.HandleFunc("/readyz", s.readyzHandler).Methods("GET")
+	router.HandleFunc("/tag", s.tagHandler).Methods("GET")
+	router.HandleFunc("/update", s.updateHandler).Methods("POST")
+	router.HandleFunc("/api/v1/pr/{number:[0-9]+}/check", s.apiCheckHandler).Methods("GET")
+	router.HandleFunc("/metrics", s.metricsHandler).Methods("GET")
+	router.HandleFunc("/admin/jobs/dead", requireAdmin(s.deadJobsHandler)).Methods("GET")
+	router.HandleFunc("/admin/deliveries", requireAdmin(s.deliveriesHandler)).Methods("GET")
+	router.HandleFunc("/admin/deliveries/{id}", requireAdmin(s.deliveryHandler)).Methods("GET")
+	router.HandleFunc("/admin/deliveries/{id}/replay", requireAdmin(s.replayDeliveryHandler)).Methods("POST")
+	router.HandleFunc("/admin/pr/{number:[0-9]+}/replay", requireAdmin(s.replayPRHandler)).Methods("POST")
 
 	//
 	////
 
-	if err := http.ListenAndServe(":"+envy.Get("PORT", "8000"), router); err != nil {
-		fmt.Println(err)
+	s.serve(&http.Server{
+		Addr:         ":" + envy.Get("PORT", "8000"),
+		Handler:      router,
+		ReadTimeout:  serverReadTimeout,
+		WriteTimeout: serverWriteTimeout,
+		IdleTimeout:  serverIdleTimeout,
+	})
+
+	if err := db.close(); err != nil {
+		logger.withError(err).errorf("failed to close store")
 	}
 }
 
-func tagHandler(w http.ResponseWriter, r *http.Request) {
-	// setting image mime type and no-cache
-	setHeaders(w)
-
-	prID := r.URL.Query().Get("pr")
-	if prID == "" {
-		if err := respondWithIcon(icnErr, w); err != nil {
-			fmt.Println(err)
-		}
-		return
+// serve runs the server until SIGTERM or SIGINT, then stops accepting requests,
+// waits for the in-flight ones and drains the job queue before returning.
+func (s *server) serve(srv *http.Server) {
+	timeout, err := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		timeout = defaultShutdownTimeout
 	}
 
-	yml, version, _, err := parseStep(prID)
-	if err != nil {
-		if err := respondWithIcon(icnErr, w); err != nil {
-			fmt.Println(err)
-		}
-		return
-	}
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- srv.ListenAndServe()
+	}()
 
-	versionParts := strings.Split(version, ".")
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
 
-	if len(versionParts) != 3 {
-		if err := respondWithIcon(icnErrSemver, w); err != nil {
-			fmt.Println(err)
-		}
+	select {
+	case err := <-stopped:
+		logger.withError(err).errorf("server stopped")
 		return
+	case sig := <-signals:
+		logger.with("signal", sig.String()).infof("shutting down")
 	}
 
-	for _, part := range versionParts {
-		if _, err := strconv.Atoi(part); err != nil {
-			if err := respondWithIcon(icnErrSemver, w); err != nil {
-				fmt.Println(err)
-			}
-			return
-		}
+	atomic.StoreInt32(&s.draining, 1)
+	deadline := time.Now().Add(timeout)
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.withError(err).errorf("failed to finish the in-flight requests")
 	}
 
-	if err := checkGithubTag(yml.Source.Git, version, yml.Source.Commit); err != nil {
-		if err := respondWithIcon(icnErrCommit, w); err != nil {
-			fmt.Println(err)
-		}
+	if err := s.jobs.drain(time.Until(deadline)); err != nil {
+		logger.withError(err).errorf("failed to drain the job queue")
 		return
 	}
 
-	if err := respondWithIcon(icnOk, w); err != nil {
-		fmt.Println(err)
-	}
+	logger.infof("shut down")
 }
 
-func isNewStep(stepID string) (bool, error) {
-	resp, err := http.Get("https://api.github.com/repos/bitrise-io/bitrise-steplib/contents/steps/" + stepID)
-	if err != nil {
-		return false, err
-	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			fmt.Printf("Failed to close body: %s", err)
-		}
-	}()
-	return resp.StatusCode == http.StatusNotFound, nil
+func (s *server) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
 }
 
-func updateHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) tagHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.with("repo", r.URL.Query().Get("repo")).with("pr", r.URL.Query().Get("pr"))
 
-	if r.Header.Get("X-Github-Event") != "pull_request" {
+	pr, err := strconv.Atoi(r.URL.Query().Get("pr"))
+	if err != nil {
+		badgeVerdicts.inc("error", "invalid_pr")
+		respondWithBadgeOrLog(log, errorBadge(), 0, w, r)
 		return
 	}
 
-	var pr pullRequestModel
-	if err := json.NewDecoder(r.Body).Decode(&pr); err != nil {
-		fmt.Println(err)
+	lib, ok := s.steplibs.lookup(r.URL.Query().Get("repo"))
+	if !ok {
+		log.warnf("badge of unknown steplib repository requested")
+		badgeVerdicts.inc("error", "unknown_repo")
+		respondWithBadgeOrLog(log, errorBadge(), 0, w, r)
 		return
 	}
 
-	if pr.Action == "opened" {
-		exists, err := isPRHasStepYML(fmt.Sprintf("%d", pr.Number))
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+	v, err := prVerdict(lib, pr)
+	if isRateLimitError(err) {
+		log.withError(err).warnf("rate limited while checking PR")
+		badgeVerdicts.inc("error", "rate_limited")
+		respondWithBadgeOrLog(log, rateLimitedBadge(), 0, w, r)
+		return
+	}
+	if err == errNoStepYML {
+		badgeVerdicts.inc("error", "no_step_yml")
+		respondWithBadgeOrLog(log, errorBadge(), 0, w, r)
+		return
+	}
+	if err != nil {
+		log.withError(err).errorf("failed to check PR")
+		badgeVerdicts.inc("error", "check_failed")
+		respondWithBadgeOrLog(log, errorBadge(), 0, w, r)
+		return
+	}
 
-		if !exists {
-			return
-		}
+	if v.Passed {
+		badgeVerdicts.inc("passed", "ok")
+	} else {
+		badgeVerdicts.inc("failed", v.failureCode())
+	}
+	respondWithBadgeOrLog(log, v.Badge, badgeMaxAge, w, r)
+}
 
-		if strings.Contains(pr.PullRequest.Body, fmt.Sprintf("https://%s/tag?pr=%d", hostBaseURL, pr.Number)) {
-			return
-		}
+func respondWithBadgeOrLog(log *jsonLogger, b badge, maxAge time.Duration, w http.ResponseWriter, r *http.Request) {
+	if err := respondWithBadge(b, maxAge, w, r); err != nil {
+		log.withError(err).errorf("failed to write badge")
+	}
+}
 
-		stepDefinition, version, stepID, err := parseStep(fmt.Sprintf("%d", pr.Number))
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+func isNewStep(lib *steplib, stepID string) (bool, error) {
+	_, exists, err := listStepVersions(lib, stepID)
+	return !exists, err
+}
 
-		newStep, err := isNewStep(stepID)
-		if err != nil {
-			fmt.Println("unable to check if", stepID, "is a new step, error:", err)
-			return
-		}
+func (s *server) updateHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.with("delivery", r.Header.Get("X-Github-Delivery")).with("event", r.Header.Get("X-Github-Event"))
 
-		apiURL := fmt.Sprintf("https://api.github.com/repos/bitrise-io/bitrise-steplib/pulls/%d", pr.Number)
-		badgeContent := fmt.Sprintf("![TagCheck](https://%s/tag?pr=%d)\r\n\r\n", hostBaseURL, pr.Number)
+	// the labels come from the request, event and action are only set once the delivery is verified
+	// and are mapped to a fixed set, so unauthenticated requests cannot add series to the metric
+	event, action, outcome := "", "", ""
+	defer func() {
+		webhookEvents.inc(event, action, outcome)
+	}()
 
-		releaseURLContent := ""
-		if strings.Contains(stepDefinition.Source.Git, "/bitrise-io/") || strings.Contains(stepDefinition.Source.Git, "/bitrise-steplib/") || strings.Contains(stepDefinition.Source.Git, "/bitrise-community/") {
-			releaseURLContent = fmt.Sprintf("%s/releases/%s\r\n\r\n", strings.TrimSuffix(stepDefinition.Source.Git, ".git"), version)
-		}
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.withError(err).warnf("failed to read webhook payload")
+		outcome = "bad_request"
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
 
-		notifications := ""
-		if newStep {
-			notifications = "\r\n\r\n"
-			notifications += "**New Step**\r\nThank you for the new Step share! The CI check might will fail due to our extended validation engine. Nothing to worry about yet, we will get back to you shortly."
-		}
+	// the repository is read before the signature is verified, as the secret depends on it
+	var envelope struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		log.withError(err).warnf("failed to parse webhook payload")
+		outcome = "bad_request"
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	log = log.with("repo", envelope.Repository.FullName)
 
-		newBody := map[string]interface{}{
-			"body": badgeContent + releaseURLContent + pr.PullRequest.Body + notifications,
-		}
+	lib, ok := s.steplibs.lookup(envelope.Repository.FullName)
+	if !ok || envelope.Repository.FullName == "" {
+		log.warnf("rejected webhook delivery of unknown repository")
+		outcome = "unknown_repo"
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
 
-		b, err := json.Marshal(newBody)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+	if err := verifySignature(payload, r.Header.Get("X-Hub-Signature-256"), lib.GitHub.WebhookSecrets); err != nil {
+		log.withError(err).warnf("rejected webhook delivery")
+		outcome = "invalid_signature"
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
 
-		c := http.Client{}
-		req, err := http.NewRequest("PATCH", apiURL, bytes.NewReader(b))
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+	event = webhookEventLabel(r.Header.Get("X-Github-Event"))
+	if event != "pull_request" {
+		outcome = "ignored"
+		return
+	}
 
-		req.SetBasicAuth(os.Getenv("GITHUB_USER"), os.Getenv("GITHUB_ACCESS_TOKEN"))
-		response, err := c.Do(req)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+	var pr pullRequestModel
+	if err := json.Unmarshal(payload, &pr); err != nil {
+		log.withError(err).warnf("failed to parse pull_request event")
+		outcome = "bad_request"
+		return
+	}
 
-		if response.StatusCode != http.StatusOK {
-			fmt.Println(fmt.Sprintf("failed to update PR, ID: %d", pr.Number))
-			fmt.Println(response)
+	pr.DeliveryID = r.Header.Get("X-Github-Delivery")
+	action = webhookActionLabel(pr.Action)
+	log = logger.forPR(lib, pr)
 
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		}
+	claimed, err := claimDelivery(pr.DeliveryID, lib, pr)
+	if err != nil {
+		log.withError(err).errorf("failed to record delivery")
+		outcome = "error"
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !claimed {
+		log.infof("skipping redelivered delivery")
+		outcome = "duplicate"
+		return
 	}
 
-	if pr.Action == "closed" && pr.PullRequest.Merged {
-		stepDefinition, version, _, err := parseStep(fmt.Sprintf("%d", pr.Number))
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+	if err := recordPayload(pr.DeliveryID, payload); err != nil {
+		log.withError(err).warnf("failed to record payload of delivery")
+	}
 
-		if strings.Contains(stepDefinition.Source.Git, "/bitrise-io/") || strings.Contains(stepDefinition.Source.Git, "/bitrise-steplib/") || strings.Contains(stepDefinition.Source.Git, "/bitrise-community/") {
-			if stepDefinition.Title == nil {
-				return
-			}
-
-			title := *stepDefinition.Title + " v" + version
-			body, err := loadReleaseBody(stepDefinition.Source.Git, version)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-
-			// append git release url
-			body += "\n\n\n" + fmt.Sprintf("%s/releases/%s\r\n\r\n", strings.TrimSuffix(stepDefinition.Source.Git, ".git"), version)
-
-			if err := createDiscourseTopic(title, body); err != nil {
-				fmt.Println(err)
-				return
-			}
+	// GitHub gives up on deliveries after 10 seconds, the event is processed in the background
+	if err := s.jobs.enqueue(newPullRequestJob(pr.DeliveryID, lib, pr)); err != nil {
+		log.withError(err).errorf("failed to enqueue event")
+		outcome = "queue_full"
+		if err := db.delete(bucketDeliveries, pr.DeliveryID); err != nil {
+			log.withError(err).errorf("failed to forget delivery")
 		}
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
 	}
+
+	log.debugf("event queued")
+	outcome = "queued"
+	w.WriteHeader(http.StatusAccepted)
 }
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds in seconds of the GitHub and Discourse latency histograms.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+var (
+	badgeVerdicts = newCounterVec("steplib_git_check_badge_verdicts_total",
+		"Badges served by verdict and reason.", "verdict", "reason")
+	webhookEvents = newCounterVec("steplib_git_check_webhook_events_total",
+		"Webhook deliveries by event, action and outcome.", "event", "action", "outcome")
+	jobOutcomes = newCounterVec("steplib_git_check_jobs_total",
+		"Processing attempts of the queued webhook events by action and outcome.", "action", "outcome")
+	githubLatency = newHistogramVec("steplib_git_check_github_request_duration_seconds",
+		"Latency of the GitHub API requests by method and status code.", latencyBuckets, "method", "status")
+	discourseLatency = newHistogramVec("steplib_git_check_discourse_request_duration_seconds",
+		"Latency of the Discourse API requests by status code.", latencyBuckets, "status")
+)
+
+// webhookEventLabel keeps the event label of webhookEvents to pull_request and other.
+func webhookEventLabel(event string) string {
+	if event == "pull_request" {
+		return event
+	}
+	return "other"
+}
+
+// webhookActionLabel keeps the action label of webhookEvents to the handled actions and other.
+func webhookActionLabel(action string) string {
+	if _, ok := pullRequestActions[action]; ok {
+		return action
+	}
+	return "other"
+}
+
+// metricsRegistry holds every metric exposed on /metrics, in registration order.
+var metricsRegistry = []metric{badgeVerdicts, webhookEvents, jobOutcomes, githubLatency, discourseLatency}
+
+type metric interface {
+	write(b *strings.Builder)
+}
+
+// labelKey joins the label values, it is the key of the series in the vectors.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+	series map[string][]string
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}, series: map[string][]string{}}
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := labelKey(values)
+	c.values[key]++
+	c.series[key] = values
+}
+
+func (c *counterVec) write(b *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.series) {
+		fmt.Fprintf(b, "%s%s %s\n", c.name, formatLabels(c.labels, c.series[key]), formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+	series map[string][]string
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogram{}, series: map[string][]string{}}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := labelKey(values)
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+		h.series[key] = values
+	}
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) observeSince(start time.Time, values ...string) {
+	h.observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *histogramVec) write(b *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		values, hist := h.series[key], h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", formatFloat(bound)), hist.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", "+Inf"), hist.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values), formatFloat(hist.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), hist.count)
+	}
+}
+
+// gaugeFunc reads its samples when the metrics are scraped, keyed by the value of its single label.
+type gaugeFunc struct {
+	name    string
+	help    string
+	label   string
+	samples func() map[string]float64
+}
+
+func (g gaugeFunc) write(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+
+	samples := g.samples()
+	keys := make([]string, 0, len(samples))
+	for key := range samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		labels := ""
+		if g.label != "" {
+			labels = formatLabels([]string{g.label}, []string{key})
+		}
+		fmt.Fprintf(b, "%s%s %s\n", g.name, labels, formatFloat(samples[key]))
+	}
+}
+
+func sortedKeys(series map[string][]string) []string {
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// serverMetrics are the gauges of the server state.
+func (s *server) serverMetrics() []metric {
+	return []metric{
+		gaugeFunc{
+			name: "steplib_git_check_github_rate_limit_remaining", help: "Remaining GitHub API requests reported by the last response, by steplib.",
+			label: "repo",
+			samples: func() map[string]float64 {
+				samples := map[string]float64{}
+				for name, lib := range s.steplibs.byName {
+					// unknown until the first response
+					if limit := lib.client.RateLimit(); limit.Limit > 0 {
+						samples[name] = float64(limit.Remaining)
+					}
+				}
+				return samples
+			},
+		},
+		gaugeFunc{
+			name: "steplib_git_check_job_queue_depth", help: "Webhook events waiting for a worker.",
+			samples: func() map[string]float64 {
+				return map[string]float64{"": float64(s.jobs.depth())}
+			},
+		},
+		gaugeFunc{
+			name: "steplib_git_check_dead_jobs", help: "Webhook events which failed after every retry.",
+			samples: func() map[string]float64 {
+				return map[string]float64{"": float64(len(s.jobs.deadJobs()))}
+			},
+		},
+	}
+}
+
+// metricsHandler writes the metrics in the Prometheus text format.
+func (s *server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	for _, m := range append(metricsRegistry, s.serverMetrics()...) {
+		m.write(&b)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := w.Write([]byte(b.String())); err != nil {
+		logger.withError(err).errorf("failed to write metrics")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhookEventsLabelsUnverifiedDeliveries(t *testing.T) {
+	lib := defaultSteplib()
+	lib.GitHub.WebhookSecrets = []string{"secret"}
+	s := &server{steplibs: &steplibRegistry{byName: map[string]*steplib{"bitrise-io/bitrise-steplib": &lib}, defaultLib: &lib}}
+
+	payload := `{"action":"made-up-action","repository":{"full_name":"bitrise-io/bitrise-steplib"}}`
+	for _, signature := range []string{"sha256=00", sign([]byte(payload), "secret")} {
+		req := httptest.NewRequest("POST", "/update", strings.NewReader(payload))
+		req.Header.Set("X-Github-Event", "made-up-event")
+		req.Header.Set("X-Hub-Signature-256", signature)
+		s.updateHandler(httptest.NewRecorder(), req)
+	}
+
+	var b strings.Builder
+	webhookEvents.write(&b)
+	metrics := b.String()
+	if strings.Contains(metrics, "made-up") {
+		t.Errorf("request labels leaked into the metric:\n%s", metrics)
+	}
+	for _, series := range []string{
+		`event="",action="",outcome="invalid_signature"`,
+		`event="other",action="",outcome="ignored"`,
+	} {
+		if !strings.Contains(metrics, series) {
+			t.Errorf("missing series %s in:\n%s", series, metrics)
+		}
+	}
+}
+
+func TestWebhookLabels(t *testing.T) {
+	if got := webhookEventLabel("pull_request"); got != "pull_request" {
+		t.Errorf("webhookEventLabel(pull_request) = %q", got)
+	}
+	if got := webhookEventLabel("push"); got != "other" {
+		t.Errorf("webhookEventLabel(push) = %q", got)
+	}
+	if got := webhookActionLabel("closed"); got != "closed" {
+		t.Errorf("webhookActionLabel(closed) = %q", got)
+	}
+	if got := webhookActionLabel("labeled"); got != "other" {
+		t.Errorf("webhookActionLabel(labeled) = %q", got)
+	}
+}
@@ -2,35 +2,21 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
-	"strings"
+	"strconv"
+	"time"
 
 	"gopkg.in/yaml.v2"
 
-	"github.com/bitrise-io/go-utils/fileutil"
-
 	stepmanModels "github.com/bitrise-io/stepman/models"
 )
 
-const (
-	icnOk        = "assets/ok.svg"
-	icnErr       = "assets/cross.svg"
-	icnErrSemver = "assets/invalid-semver.svg"
-	icnErrCommit = "assets/invalid-commit.svg"
-	hostBaseURL  = "bitrise-steplib-git-check.herokuapp.com"
-)
-
-type githubtag struct {
-	Name   string `json:"name"`
-	Commit struct {
-		SHA string `json:"sha"`
-	} `json:"commit"`
-}
+var errNoStepYML = errors.New("no step.yml found")
 
 type githubrelease struct {
 	Body string `json:"body"`
@@ -40,171 +26,260 @@ type pullRequestModel struct {
 	Action      string  `json:"action"`
 	Number      int     `json:"number"`
 	PullRequest content `json:"pull_request"`
+	Changes     changes `json:"changes"`
+	// DeliveryID is the X-GitHub-Delivery header of the event, the actions record what they did under it.
+	DeliveryID string `json:"-"`
+}
+
+type changes struct {
+	Body *struct {
+		From string `json:"from"`
+	} `json:"body"`
 }
 
 type content struct {
+	State  string `json:"state"`
 	Merged bool   `json:"merged"`
 	Number int    `json:"number"`
 	Body   string `json:"body"`
+	Head   struct {
+		SHA string `json:"sha"`
+	} `json:"head"`
 }
 
 type file struct {
 	Filename string `json:"filename"`
-	RawURL   string `json:"raw_url"`
+	Status   string `json:"status"`
 }
 
-func checkGithubTag(giturl string, tag string, commit string) error {
-	giturl = strings.TrimSuffix(giturl, ".git")
-	giturl = strings.Replace(giturl, "https://github.com/", "https://api.github.com/repos/", 1)
-	giturl = giturl + "/tags"
+type contentEntry struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
 
-	var tags []githubtag
+type stepFile struct {
+	Path    string
+	Status  string
+	Raw     []byte
+	ID      string
+	Version string
+	Step    stepmanModels.StepModel
+}
 
-	if err := httpLoadJSON(giturl, &tags); err != nil {
+func httpLoadJSON(c *githubClient, url string, model interface{}) error {
+	return loadJSON(c.get, url, model)
+}
+
+// httpLoadCurrentJSON is httpLoadJSON for the resources which have to be up to date, cached responses are revalidated.
+func httpLoadCurrentJSON(c *githubClient, url string, model interface{}) error {
+	return loadJSON(c.getCurrent, url, model)
+}
+
+func loadJSON(get func(url string) ([]byte, bool, error), url string, model interface{}) error {
+	b, found, err := get(url)
+	if err != nil {
 		return err
 	}
-
-	for _, t := range tags {
-		if t.Name == tag && t.Commit.SHA == commit {
-			return nil
-		}
+	if !found {
+		return fmt.Errorf("not found: %s", url)
 	}
 
-	return fmt.Errorf("not found")
+	if err := json.Unmarshal(b, model); err != nil {
+		return fmt.Errorf("failed to parse response of %s: %s", url, err)
+	}
+	return nil
 }
 
-func loadReleaseBody(giturl string, tag string) (string, error) {
-	giturl = strings.TrimSuffix(giturl, ".git")
-	giturl = strings.Replace(giturl, "https://github.com/", "https://api.github.com/repos/", 1)
-	giturl = giturl + "/releases/tags/" + tag
-
-	var release githubrelease
-
-	if err := httpLoadJSON(giturl, &release); err != nil {
-		return "", err
+// httpLoadJSONIfExists is httpLoadJSON for resources which might not exist, found is false on 404.
+func httpLoadJSONIfExists(c *githubClient, url string, model interface{}) (found bool, err error) {
+	b, found, err := c.get(url)
+	if err != nil || !found {
+		return false, err
 	}
 
-	return release.Body, nil
+	return true, json.Unmarshal(b, model)
 }
 
-func setHeaders(w http.ResponseWriter) {
-	w.Header().Add("Content-Type", "image/svg+xml")
-	w.Header().Add("Cache-Control", "no-cache")
-}
-
-func respondWithIcon(icn string, w http.ResponseWriter) error {
-	b, err := fileutil.ReadBytesFromFile(icn)
+// httpSendJSON sends model to the GitHub API authenticated with the client's credentials.
+func httpSendJSON(c *githubClient, method, url string, model interface{}) error {
+	b, err := json.Marshal(model)
 	if err != nil {
 		return err
 	}
-	_, err = w.Write(b)
-	return err
+
+	return c.send(method, url, b)
 }
 
-func httpLoadJSON(url string, model interface{}) error {
-	r, err := http.Get(url)
+func loadPRHeadSHA(lib *steplib, pr int) (string, error) {
+	pullRequest, err := lib.github.pullRequest(pr)
 	if err != nil {
-		return err
+		return "", err
 	}
+	return pullRequest.Head.SHA, nil
+}
 
-	b, err := ioutil.ReadAll(r.Body)
+func isPRHasStepYML(lib *steplib, pr int) (bool, error) {
+	files, err := lib.github.pullRequestFiles(pr)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	if err := json.Unmarshal(b, model); err != nil {
-		fmt.Println(url, string(b))
-		return err
+	for _, file := range files {
+		if lib.isStepYML(file.Filename) && file.Status != "removed" {
+			return true, nil
+		}
 	}
-	return nil
+
+	return false, nil
 }
 
-func httpLoadYML(url string, model interface{}) error {
-	r, err := http.Get(url)
-	if err != nil {
-		return err
+// listStepVersions returns the version directories of the step in the steplib, exists is false for new steps.
+func listStepVersions(lib *steplib, stepID string) (versions []string, exists bool, err error) {
+	entries, exists, err := lib.github.contents(lib.StepsPrefix + stepID)
+	if err != nil || !exists {
+		return nil, false, err
 	}
-	if err := yaml.NewDecoder(r.Body).Decode(model); err != nil {
-		return err
+
+	for _, entry := range entries {
+		if entry.Type == "dir" {
+			versions = append(versions, entry.Name)
+		}
 	}
-	return nil
+
+	return versions, true, nil
 }
 
-func isPRHasStepYML(prID string) (bool, error) {
-	var files []file
-	if err := httpLoadJSON(fmt.Sprintf("https://api.github.com/repos/bitrise-io/bitrise-steplib/pulls/%s/files", prID), &files); err != nil {
-		return false, err
+// parseSteps returns every step.yml added or modified by the PR, as they are at the head commit.
+func parseSteps(lib *steplib, pr int, headSHA string) ([]stepFile, error) {
+	steps, err := changedSteps(lib, pr, headSHA)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, file := range files {
-		if strings.HasSuffix(file.Filename, "/step.yml") && strings.HasPrefix(file.Filename, "steps/") {
-			return true, nil
+	for _, step := range steps {
+		if step.Step.Source == nil {
+			return nil, fmt.Errorf("no source in %s", step.Path)
 		}
 	}
 
-	return false, nil
+	return steps, nil
 }
 
-func parseStep(prID string) (stepmanModels.StepModel, string, string, error) {
-	var files []file
-	if err := httpLoadJSON(fmt.Sprintf("https://api.github.com/repos/bitrise-io/bitrise-steplib/pulls/%s/files", prID), &files); err != nil {
-		return stepmanModels.StepModel{}, "", "", err
+// changedSteps loads the step.yml files the PR adds, modifies or renames at the ref, errNoStepYML if there is none.
+func changedSteps(lib *steplib, pr int, ref string) ([]stepFile, error) {
+	files, err := lib.github.pullRequestFiles(pr)
+	if err != nil {
+		return nil, err
 	}
 
+	var steps []stepFile
 	for _, file := range files {
-		if strings.HasSuffix(file.Filename, "step.yml") && strings.HasPrefix(file.Filename, "steps/") {
-			var yml stepmanModels.StepModel
-			if err := httpLoadYML(file.RawURL, &yml); err != nil {
-				return stepmanModels.StepModel{}, "", "", err
-			}
-
-			if yml.Source == nil {
-				return stepmanModels.StepModel{}, "", "", fmt.Errorf("no source in step.yml")
-			}
-
-			versionDir := filepath.Dir(file.Filename)
-			version := filepath.Base(versionDir)
-			stepIDDir := filepath.Dir(versionDir)
-			stepID := filepath.Base(stepIDDir)
-
-			return yml, version, stepID, nil
+		if !lib.isStepYML(file.Filename) || file.Status == "removed" {
+			continue
 		}
+
+		step, err := loadStepFile(lib, file, ref)
+		if err != nil {
+			return nil, err
+		}
+
+		steps = append(steps, step)
 	}
 
-	return stepmanModels.StepModel{}, "", "", fmt.Errorf("no step.yml found")
+	if len(steps) == 0 {
+		return nil, errNoStepYML
+	}
+
+	return steps, nil
+}
+
+// loadStepFile parses the changed step.yml at the ref, the step ID and version come from its steps/<id>/<version>/ path.
+func loadStepFile(lib *steplib, file file, ref string) (stepFile, error) {
+	raw, err := lib.github.fileContent(file.Filename, ref)
+	if err != nil {
+		return stepFile{}, err
+	}
+
+	var yml stepmanModels.StepModel
+	if err := yaml.Unmarshal(raw, &yml); err != nil {
+		return stepFile{}, fmt.Errorf("failed to parse %s: %s", file.Filename, err)
+	}
+
+	versionDir := filepath.Dir(file.Filename)
+	version := filepath.Base(versionDir)
+	stepIDDir := filepath.Dir(versionDir)
+	stepID := filepath.Base(stepIDDir)
+
+	return stepFile{
+		Path:    file.Filename,
+		Status:  file.Status,
+		Raw:     raw,
+		ID:      stepID,
+		Version: version,
+		Step:    yml,
+	}, nil
+}
+
+type discourseConfig struct {
+	URL         string `yaml:"url"`
+	APIKey      string `yaml:"api_key"`
+	APIUsername string `yaml:"api_username"`
+	Category    string `yaml:"category"`
 }
 
-func createDiscourseTopic(title, body string) error {
-	apiKey := os.Getenv("DISCOURSE_API_KEY")
-	if apiKey == "" {
-		return fmt.Errorf("DISCOURSE_API_KEY is not set")
+func discourseConfigFromEnv() discourseConfig {
+	return discourseConfig{
+		URL:         os.Getenv("DISCOURSE_URL"),
+		APIKey:      os.Getenv("DISCOURSE_API_KEY"),
+		APIUsername: os.Getenv("DISCOURSE_API_USERNAME"),
+		Category:    os.Getenv("DISCOURSE_CATEGORY"),
 	}
-	userName := os.Getenv("DISCOURSE_API_USERNAME")
-	if userName == "" {
-		return fmt.Errorf("DISCOURSE_API_USERNAME is not set")
+}
+
+func (c discourseConfig) withDefaults(defaults discourseConfig) discourseConfig {
+	if c.URL == "" {
+		return defaults
 	}
-	category := os.Getenv("DISCOURSE_CATEGORY")
-	if category == "" {
-		return fmt.Errorf("DISCOURSE_CATEGORY is not set")
+	return c
+}
+
+func createDiscourseTopic(cfg discourseConfig, title, body string) error {
+	if cfg.APIKey == "" {
+		return fmt.Errorf("discourse api_key is not set")
 	}
-	discourseURL := os.Getenv("DISCOURSE_URL")
-	if discourseURL == "" {
-		return fmt.Errorf("DISCOURSE_URL is not set")
+	if cfg.APIUsername == "" {
+		return fmt.Errorf("discourse api_username is not set")
+	}
+	if cfg.Category == "" {
+		return fmt.Errorf("discourse category is not set")
+	}
+	if cfg.URL == "" {
+		return fmt.Errorf("discourse url is not set")
 	}
 
 	formData := url.Values{}
-	formData.Set("api_key", apiKey)
-	formData.Set("api_username", userName)
+	formData.Set("api_key", cfg.APIKey)
+	formData.Set("api_username", cfg.APIUsername)
 	formData.Set("raw", body)
-	formData.Set("category", category)
+	formData.Set("category", cfg.Category)
 	formData.Set("title", title)
 
-	resp, err := http.PostForm(discourseURL+"/posts.json", formData)
+	start := time.Now()
+	client := &http.Client{Timeout: 30 * time.Second, Transport: httpTransport}
+	resp, err := client.PostForm(cfg.URL+"/posts.json", formData)
 	if err != nil {
+		discourseLatency.observeSince(start, "error")
 		return err
 	}
+	discourseLatency.observeSince(start, strconv.Itoa(resp.StatusCode))
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.withError(err).warnf("failed to close body")
+		}
+	}()
+
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return fmt.Errorf("Invalid response code: %d from: %s", resp.StatusCode, discourseURL+"/posts.json")
+		return fmt.Errorf("Invalid response code: %d from: %s", resp.StatusCode, cfg.URL+"/posts.json")
 	}
 
 	return nil
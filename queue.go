@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQueueWorkers = 4
+	defaultQueueSize    = 100
+	jobMaxAttempts      = 5
+	jobMaxRetryDelay    = time.Minute
+	maxDeadJobs         = 100
+)
+
+// jobRetryDelay is the wait before the second attempt of a job, doubled on every further attempt.
+var jobRetryDelay = 2 * time.Second
+
+var (
+	errQueueFull   = errors.New("job queue is full")
+	errQueueClosed = errors.New("job queue is shutting down")
+)
+
+// job is a webhook event waiting to be processed, ID is the GitHub delivery ID.
+type job struct {
+	ID         string    `json:"id"`
+	Repo       string    `json:"repo"`
+	PR         int       `json:"pr"`
+	Action     string    `json:"action"`
+	Attempts   int       `json:"attempts"`
+	Errors     []string  `json:"errors,omitempty"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+	FailedAt   time.Time `json:"failed_at,omitempty"`
+
+	lib   *steplib
+	event pullRequestModel
+}
+
+func newPullRequestJob(id string, lib *steplib, event pullRequestModel) *job {
+	return &job{
+		ID:         id,
+		Repo:       lib.fullName(),
+		PR:         event.Number,
+		Action:     event.Action,
+		EnqueuedAt: time.Now(),
+		lib:        lib,
+		event:      event,
+	}
+}
+
+// jobQueue processes the jobs on a fixed number of workers. The jobs of a PR always go to the same worker,
+// so they are processed one after the other in the order they arrived. A failed job waits for its retry
+// on a timer, not on the worker, and is then queued again behind the jobs which arrived meanwhile.
+type jobQueue struct {
+	shards []chan *job
+	run    func(j *job) error
+
+	workers sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+	// retries are the timers of the failed jobs waiting for their next attempt
+	retries map[*job]*time.Timer
+	dead    []job
+}
+
+func newJobQueue(workers, size int, run func(j *job) error) *jobQueue {
+	q := &jobQueue{run: run, retries: map[*job]*time.Timer{}}
+	for i := 0; i < workers; i++ {
+		shard := make(chan *job, size)
+		q.shards = append(q.shards, shard)
+		q.workers.Add(1)
+		go q.work(shard)
+	}
+	return q
+}
+
+// newJobQueueFromEnv sizes the queue with QUEUE_WORKERS and QUEUE_SIZE, the number of jobs each worker can hold.
+func newJobQueueFromEnv(run func(j *job) error) *jobQueue {
+	workers, err := strconv.Atoi(os.Getenv("QUEUE_WORKERS"))
+	if err != nil || workers <= 0 {
+		workers = defaultQueueWorkers
+	}
+
+	size, err := strconv.Atoi(os.Getenv("QUEUE_SIZE"))
+	if err != nil || size <= 0 {
+		size = defaultQueueSize
+	}
+
+	return newJobQueue(workers, size, run)
+}
+
+// enqueue does not block, it returns errQueueFull if the worker of the PR is too far behind.
+func (q *jobQueue) enqueue(j *job) error {
+	h := fnv.New32a()
+	if _, err := fmt.Fprintf(h, "%s#%d", j.Repo, j.PR); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return errQueueClosed
+	}
+
+	select {
+	case q.shards[h.Sum32()%uint32(len(q.shards))] <- j:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+func (q *jobQueue) work(shard chan *job) {
+	defer q.workers.Done()
+
+	for j := range shard {
+		q.process(j)
+	}
+}
+
+// drain stops accepting jobs and waits until the queued ones are processed, or the timeout passes.
+// Failing jobs are not retried while draining, the ones waiting for a retry end up in the dead-letter list at once.
+func (q *jobQueue) drain(timeout time.Duration) error {
+	var waiting []*job
+
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		for _, shard := range q.shards {
+			close(shard)
+		}
+		for j, timer := range q.retries {
+			timer.Stop()
+			waiting = append(waiting, j)
+			delete(q.retries, j)
+		}
+	}
+	q.mu.Unlock()
+
+	for _, j := range waiting {
+		j.logger().errorf("giving up job, the server is shutting down")
+		q.bury(j)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("%d jobs were not processed in %s", q.depth(), timeout)
+	}
+}
+
+// process runs an attempt of the job, a failed job is retried later until it runs out of attempts,
+// then it ends up in the dead-letter list.
+func (q *jobQueue) process(j *job) {
+	j.Attempts++
+
+	panicked, err := q.runSafely(j)
+	if err == nil {
+		return
+	}
+
+	j.Errors = append(j.Errors, err.Error())
+
+	if panicked {
+		j.logger().withError(err).errorf("giving up job, it panicked")
+		q.bury(j)
+		return
+	}
+	if j.Attempts >= jobMaxAttempts {
+		j.logger().withError(err).errorf("giving up job after %d attempts", j.Attempts)
+		q.bury(j)
+		return
+	}
+
+	wait := jobBackoff(j.Attempts)
+	if rateLimitErr, ok := err.(rateLimitError); ok {
+		wait = time.Until(rateLimitErr.Reset)
+	}
+	if wait > jobMaxRetryDelay {
+		wait = jobMaxRetryDelay
+	}
+
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		j.logger().withError(err).errorf("giving up job, the server is shutting down")
+		q.bury(j)
+		return
+	}
+	// retry takes the lock too, so it cannot run before its timer is registered
+	q.retries[j] = time.AfterFunc(wait, func() { q.retry(j) })
+	q.mu.Unlock()
+
+	j.logger().withError(err).warnf("retrying job in %s", wait)
+	jobOutcomes.inc(j.Action, "retry")
+}
+
+// retry queues the job again once its wait is over, unless drain has buried it already.
+func (q *jobQueue) retry(j *job) {
+	q.mu.Lock()
+	_, waiting := q.retries[j]
+	delete(q.retries, j)
+	q.mu.Unlock()
+
+	if !waiting {
+		return
+	}
+
+	if err := q.enqueue(j); err != nil {
+		j.logger().withError(err).errorf("giving up job, it could not be queued again")
+		q.bury(j)
+	}
+}
+
+// runSafely turns a panic of the job into an error, so it cannot take down the worker and with it its shard.
+// A panic is not retried, it would most likely panic again.
+func (q *jobQueue) runSafely(j *job) (panicked bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked, err = true, fmt.Errorf("panic: %v", r)
+			j.logger().with("stack", string(debug.Stack())).errorf("job panicked: %v", r)
+			logDelivery(j.ID, "attempt %d panicked: %v", j.Attempts, r)
+		}
+	}()
+	return false, q.run(j)
+}
+
+func (j *job) logger() *jsonLogger {
+	return logger.with("delivery", j.ID).with("repo", j.Repo).with("pr", j.PR).with("action", j.Action).with("attempt", j.Attempts)
+}
+
+// bury moves the job to the dead-letter list, its delivery is marked failed so it can be redelivered or replayed.
+func (q *jobQueue) bury(j *job) {
+	jobOutcomes.inc(j.Action, "failed")
+	finishDelivery(j.ID, deliveryFailed)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j.FailedAt = time.Now()
+	q.dead = append(q.dead, *j)
+	if len(q.dead) > maxDeadJobs {
+		q.dead = q.dead[len(q.dead)-maxDeadJobs:]
+	}
+}
+
+// deadJobs returns the jobs which ran out of attempts, oldest first.
+func (q *jobQueue) deadJobs() []job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return append([]job{}, q.dead...)
+}
+
+// depth is the number of jobs waiting for a worker.
+func (q *jobQueue) depth() int {
+	n := 0
+	for _, shard := range q.shards {
+		n += len(shard)
+	}
+	return n
+}
+
+func jobBackoff(attempt int) time.Duration {
+	return jobRetryDelay * time.Duration(math.Pow(2, float64(attempt-1)))
+}
+
+func runPullRequestJob(j *job) error {
+	err := dispatchPullRequest(j.lib, j.event)
+	if err != nil {
+		logDelivery(j.ID, "attempt %d failed: %s", j.Attempts, err)
+	}
+
+	if err == nil {
+		jobOutcomes.inc(j.Action, "done")
+		finishDelivery(j.ID, deliveryDone)
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJobQueueBuriesPanickingJob(t *testing.T) {
+	runs := 0
+	q := newJobQueue(1, 10, func(j *job) error {
+		runs++
+		if j.PR == 1 {
+			panic("boom")
+		}
+		return nil
+	})
+
+	lib := &steplib{Owner: "bitrise-io", Repo: "bitrise-steplib"}
+	for _, pr := range []int{1, 2} {
+		if err := q.enqueue(newPullRequestJob("delivery", lib, pullRequestModel{Action: "opened", Number: pr})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.drain(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if runs != 2 {
+		t.Errorf("runs = %d, want 2: the panic must not be retried or stop the worker", runs)
+	}
+	dead := q.deadJobs()
+	if len(dead) != 1 || dead[0].PR != 1 || dead[0].Attempts != 1 {
+		t.Fatalf("dead jobs = %+v, want the panicking PR after 1 attempt", dead)
+	}
+	if len(dead[0].Errors) != 1 || dead[0].Errors[0] != "panic: boom" {
+		t.Errorf("errors = %q", dead[0].Errors)
+	}
+}
+
+func TestJobQueueBuriesFailingJobWhenDraining(t *testing.T) {
+	q := newJobQueue(1, 10, func(j *job) error { return errors.New("GitHub is down") })
+
+	lib := &steplib{Owner: "bitrise-io", Repo: "bitrise-steplib"}
+	if err := q.enqueue(newPullRequestJob("delivery", lib, pullRequestModel{Action: "opened", Number: 1})); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.drain(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if dead := q.deadJobs(); len(dead) != 1 || dead[0].Attempts != 1 {
+		t.Fatalf("dead jobs = %+v, want the job after 1 attempt", dead)
+	}
+	if err := q.enqueue(newPullRequestJob("late", lib, pullRequestModel{Number: 2})); err != errQueueClosed {
+		t.Errorf("enqueue after drain = %v, want errQueueClosed", err)
+	}
+}
+
+func TestJobQueueRetryDoesNotBlockWorker(t *testing.T) {
+	defer func(previous time.Duration) { jobRetryDelay = previous }(jobRetryDelay)
+	jobRetryDelay = 100 * time.Millisecond
+
+	var mu sync.Mutex
+	var runs []int
+	done := make(chan struct{})
+	q := newJobQueue(1, 10, func(j *job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		runs = append(runs, j.PR)
+		if j.PR == 1 && j.Attempts == 1 {
+			return errors.New("GitHub is down")
+		}
+		if len(runs) == 3 {
+			close(done)
+		}
+		return nil
+	})
+
+	lib := &steplib{Owner: "bitrise-io", Repo: "bitrise-steplib"}
+	for _, pr := range []int{1, 2} {
+		if err := q.enqueue(newPullRequestJob("delivery", lib, pullRequestModel{Action: "opened", Number: pr})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the retry did not run")
+	}
+	if err := q.drain(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// the only worker processes PR 2 while PR 1 waits for its retry
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(runs, []int{1, 2, 1}) {
+		t.Errorf("runs = %v, want [1 2 1]", runs)
+	}
+	if dead := q.deadJobs(); len(dead) != 0 {
+		t.Errorf("dead jobs = %+v", dead)
+	}
+}
+
+func TestJobQueueDrainBuriesWaitingRetries(t *testing.T) {
+	defer func(previous time.Duration) { jobRetryDelay = previous }(jobRetryDelay)
+	jobRetryDelay = time.Hour
+
+	failed := make(chan struct{})
+	q := newJobQueue(1, 10, func(j *job) error {
+		defer close(failed)
+		return errors.New("GitHub is down")
+	})
+
+	lib := &steplib{Owner: "bitrise-io", Repo: "bitrise-steplib"}
+	if err := q.enqueue(newPullRequestJob("delivery", lib, pullRequestModel{Action: "opened", Number: 1})); err != nil {
+		t.Fatal(err)
+	}
+	<-failed
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		q.mu.Lock()
+		waiting := len(q.retries)
+		q.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the retry was not scheduled")
+		}
+	}
+
+	// the job waits for its retry on a timer, drain does not wait for it
+	start := time.Now()
+	if err := q.drain(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("drain took %s", elapsed)
+	}
+	if dead := q.deadJobs(); len(dead) != 1 || dead[0].Attempts != 1 || dead[0].Errors[0] != "GitHub is down" {
+		t.Fatalf("dead jobs = %+v, want the job after 1 attempt", dead)
+	}
+}
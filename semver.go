@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SemVer 2.0.0 violations, see https://semver.org/spec/v2.0.0.html
+const (
+	semverEmpty                = "semver-empty"
+	semverInvalidFormat        = "semver-invalid-format"
+	semverNonNumeric           = "semver-non-numeric"
+	semverNegative             = "semver-negative-number"
+	semverLeadingZero          = "semver-leading-zero"
+	semverInvalidPreRelease    = "semver-invalid-prerelease"
+	semverInvalidBuild         = "semver-invalid-build"
+	semverPreReleaseNotAllowed = "semver-prerelease-not-allowed"
+	semverBuildNotAllowed      = "semver-build-not-allowed"
+)
+
+var semverShortReasons = map[string]string{
+	semverEmpty:                "empty version",
+	semverInvalidFormat:        "not MAJOR.MINOR.PATCH",
+	semverNonNumeric:           "non numeric part",
+	semverNegative:             "negative number",
+	semverLeadingZero:          "leading zero",
+	semverInvalidPreRelease:    "invalid pre-release",
+	semverInvalidBuild:         "invalid build metadata",
+	semverPreReleaseNotAllowed: "pre-release not allowed",
+	semverBuildNotAllowed:      "build metadata not allowed",
+}
+
+type semver struct {
+	Major      uint64
+	Minor      uint64
+	Patch      uint64
+	PreRelease []string
+	Build      []string
+}
+
+type semverError struct {
+	Code    string
+	Version string
+	Message string
+}
+
+func (e semverError) Error() string {
+	return fmt.Sprintf("version %s: %s", e.Version, e.Message)
+}
+
+// Short describes the violation in a few words, to fit on the badge.
+func (e semverError) Short() string {
+	if e.Version == "" {
+		return semverShortReasons[e.Code]
+	}
+	return fmt.Sprintf("%s %s", e.Version, semverShortReasons[e.Code])
+}
+
+type semverPolicy struct {
+	AllowPreRelease bool
+	AllowBuild      bool
+}
+
+func semverPolicyFromEnv() semverPolicy {
+	return semverPolicy{
+		AllowPreRelease: os.Getenv("SEMVER_ALLOW_PRERELEASE") == "true",
+		AllowBuild:      os.Getenv("SEMVER_ALLOW_BUILD_METADATA") == "true",
+	}
+}
+
+func (v semver) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.PreRelease) > 0 {
+		s += "-" + strings.Join(v.PreRelease, ".")
+	}
+	if len(v.Build) > 0 {
+		s += "+" + strings.Join(v.Build, ".")
+	}
+	return s
+}
+
+func parseSemver(version string) (semver, error) {
+	newError := func(code, format string, args ...interface{}) error {
+		return semverError{Code: code, Version: version, Message: fmt.Sprintf(format, args...)}
+	}
+
+	if version == "" {
+		return semver{}, newError(semverEmpty, "version is empty")
+	}
+
+	// a hyphen at the start of MAJOR, MINOR or PATCH is a minus sign, not the pre-release separator
+	for _, part := range strings.SplitN(version, ".", 3) {
+		if strings.HasPrefix(part, "-") {
+			return semver{}, newError(semverNegative, "%s is negative, MAJOR.MINOR.PATCH are non-negative integers", strings.SplitN(part, "+", 2)[0])
+		}
+	}
+
+	var v semver
+
+	core := version
+	if i := strings.Index(core, "+"); i != -1 {
+		build := core[i+1:]
+		core = core[:i]
+
+		v.Build = strings.Split(build, ".")
+		for _, identifier := range v.Build {
+			if identifier == "" || !isAlphanumericIdentifier(identifier) {
+				return semver{}, newError(semverInvalidBuild, "build metadata %q should be dot separated non empty [0-9A-Za-z-] identifiers", build)
+			}
+		}
+	}
+
+	if i := strings.Index(core, "-"); i != -1 {
+		preRelease := core[i+1:]
+		core = core[:i]
+
+		v.PreRelease = strings.Split(preRelease, ".")
+		for _, identifier := range v.PreRelease {
+			if identifier == "" || !isAlphanumericIdentifier(identifier) {
+				return semver{}, newError(semverInvalidPreRelease, "pre-release %q should be dot separated non empty [0-9A-Za-z-] identifiers", preRelease)
+			}
+			if isNumericIdentifier(identifier) && len(identifier) > 1 && identifier[0] == '0' {
+				return semver{}, newError(semverLeadingZero, "numeric pre-release identifier %s has a leading zero", identifier)
+			}
+		}
+	}
+
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 {
+		return semver{}, newError(semverInvalidFormat, "should have exactly 3 parts (MAJOR.MINOR.PATCH)")
+	}
+
+	var numbers []uint64
+	for _, part := range parts {
+		if part == "" || !isNumericIdentifier(part) {
+			return semver{}, newError(semverNonNumeric, "%q is not a non-negative integer", part)
+		}
+		if len(part) > 1 && part[0] == '0' {
+			return semver{}, newError(semverLeadingZero, "%s has a leading zero", part)
+		}
+
+		number, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return semver{}, newError(semverNonNumeric, "%s is out of range", part)
+		}
+		numbers = append(numbers, number)
+	}
+	v.Major, v.Minor, v.Patch = numbers[0], numbers[1], numbers[2]
+
+	return v, nil
+}
+
+// validate parses the version and checks it against the policy.
+func (p semverPolicy) validate(version string) (semver, error) {
+	v, err := parseSemver(version)
+	if err != nil {
+		return semver{}, err
+	}
+
+	if len(v.PreRelease) > 0 && !p.AllowPreRelease {
+		return semver{}, semverError{Code: semverPreReleaseNotAllowed, Version: version, Message: "pre-release versions are not allowed"}
+	}
+
+	if len(v.Build) > 0 && !p.AllowBuild {
+		return semver{}, semverError{Code: semverBuildNotAllowed, Version: version, Message: "build metadata is not allowed"}
+	}
+
+	return v, nil
+}
+
+// compareSemver returns -1, 0 or 1 if a has lower, equal or higher precedence than b, build metadata is ignored.
+func compareSemver(a, b semver) int {
+	for _, pair := range [][2]uint64{{a.Major, b.Major}, {a.Minor, b.Minor}, {a.Patch, b.Patch}} {
+		if pair[0] != pair[1] {
+			return compareUint(pair[0], pair[1])
+		}
+	}
+
+	// a version without pre-release has higher precedence
+	switch {
+	case len(a.PreRelease) == 0 && len(b.PreRelease) == 0:
+		return 0
+	case len(a.PreRelease) == 0:
+		return 1
+	case len(b.PreRelease) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(a.PreRelease) && i < len(b.PreRelease); i++ {
+		if c := comparePreReleaseIdentifier(a.PreRelease[i], b.PreRelease[i]); c != 0 {
+			return c
+		}
+	}
+
+	return compareUint(uint64(len(a.PreRelease)), uint64(len(b.PreRelease)))
+}
+
+func comparePreReleaseIdentifier(a, b string) int {
+	aNumeric, bNumeric := isNumericIdentifier(a), isNumericIdentifier(b)
+
+	switch {
+	case aNumeric && bNumeric:
+		aNumber, aErr := strconv.ParseUint(a, 10, 64)
+		bNumber, bErr := strconv.ParseUint(b, 10, 64)
+		if aErr == nil && bErr == nil {
+			return compareUint(aNumber, bNumber)
+		}
+	case aNumeric:
+		// numeric identifiers have lower precedence than alphanumeric ones
+		return -1
+	case bNumeric:
+		return 1
+	}
+
+	return strings.Compare(a, b)
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func isNumericIdentifier(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func isAlphanumericIdentifier(s string) bool {
+	for _, r := range s {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
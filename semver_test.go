@@ -0,0 +1,143 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSemver(t *testing.T) {
+	for _, tc := range []struct {
+		version string
+		want    semver
+	}{
+		{"0.0.0", semver{}},
+		{"1.2.3", semver{Major: 1, Minor: 2, Patch: 3}},
+		{"10.20.30", semver{Major: 10, Minor: 20, Patch: 30}},
+		{"1.0.0-alpha", semver{Major: 1, PreRelease: []string{"alpha"}}},
+		{"1.0.0-alpha.1", semver{Major: 1, PreRelease: []string{"alpha", "1"}}},
+		{"1.0.0-0.3.7", semver{Major: 1, PreRelease: []string{"0", "3", "7"}}},
+		{"1.0.0-x-y-z.--", semver{Major: 1, PreRelease: []string{"x-y-z", "--"}}},
+		{"1.0.0-alpha+001", semver{Major: 1, PreRelease: []string{"alpha"}, Build: []string{"001"}}},
+		{"1.0.0+20130313144700", semver{Major: 1, Build: []string{"20130313144700"}}},
+		{"1.0.0-beta+exp.sha.5114f85", semver{Major: 1, PreRelease: []string{"beta"}, Build: []string{"exp", "sha", "5114f85"}}},
+		{"1.0.0+21AF26D3----117B344092BD", semver{Major: 1, Build: []string{"21AF26D3----117B344092BD"}}},
+	} {
+		t.Run(tc.version, func(t *testing.T) {
+			got, err := parseSemver(tc.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parseSemver = %+v, want %+v", got, tc.want)
+			}
+			if got.String() != tc.version {
+				t.Errorf("String() = %s, want %s", got, tc.version)
+			}
+		})
+	}
+}
+
+func TestParseSemverViolations(t *testing.T) {
+	for version, code := range map[string]string{
+		"":                         semverEmpty,
+		"1.2":                      semverInvalidFormat,
+		"1.2.3.4":                  semverInvalidFormat,
+		"v1.2.3":                   semverNonNumeric,
+		"1.2.x":                    semverNonNumeric,
+		"1..3":                     semverNonNumeric,
+		"1.2.99999999999999999999": semverNonNumeric,
+		"-1.2.3":                   semverNegative,
+		"1.-2.3":                   semverNegative,
+		"1.2.-3":                   semverNegative,
+		"-1.2.3+build":             semverNegative,
+		"01.2.3":                   semverLeadingZero,
+		"1.02.3":                   semverLeadingZero,
+		"1.2.03":                   semverLeadingZero,
+		"1.2.3-01":                 semverLeadingZero,
+		"1.2.3-":                   semverInvalidPreRelease,
+		"1.2.3-alpha..1":           semverInvalidPreRelease,
+		"1.2.3-alpha_1":            semverInvalidPreRelease,
+		"1.2.3+":                   semverInvalidBuild,
+		"1.2.3+build..1":           semverInvalidBuild,
+		"1.2.3+build!":             semverInvalidBuild,
+	} {
+		_, err := parseSemver(version)
+		semverErr, ok := err.(semverError)
+		if !ok || semverErr.Code != code {
+			t.Errorf("parseSemver(%q) = %v, want %s", version, err, code)
+		}
+	}
+
+	// leading zeros are allowed in the build metadata and in alphanumeric pre-release identifiers
+	for _, version := range []string{"1.2.3+001", "1.2.3-0alpha", "1.2.3-0"} {
+		if _, err := parseSemver(version); err != nil {
+			t.Errorf("parseSemver(%q) = %v", version, err)
+		}
+	}
+}
+
+func TestSemverPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy  semverPolicy
+		version string
+		code    string
+	}{
+		{semverPolicy{}, "1.2.3", ""},
+		{semverPolicy{}, "1.2.3-beta.1", semverPreReleaseNotAllowed},
+		{semverPolicy{}, "1.2.3+build.1", semverBuildNotAllowed},
+		{semverPolicy{AllowPreRelease: true}, "1.2.3-beta.1", ""},
+		{semverPolicy{AllowPreRelease: true}, "1.2.3-beta.1+build.1", semverBuildNotAllowed},
+		{semverPolicy{AllowBuild: true}, "1.2.3+build.1", ""},
+		{semverPolicy{AllowPreRelease: true, AllowBuild: true}, "1.2.3-beta.1+build.1", ""},
+		{semverPolicy{AllowPreRelease: true, AllowBuild: true}, "1.2.03", semverLeadingZero},
+	} {
+		_, err := tc.policy.validate(tc.version)
+		code := ""
+		if semverErr, ok := err.(semverError); ok {
+			code = semverErr.Code
+		} else if err != nil {
+			t.Fatalf("validate(%s) = %v, want a semverError", tc.version, err)
+		}
+		if code != tc.code {
+			t.Errorf("%+v validate(%s) = %v, want %q", tc.policy, tc.version, err, tc.code)
+		}
+	}
+}
+
+func TestCompareSemver(t *testing.T) {
+	// in increasing precedence, the examples of the spec
+	ordered := []string{
+		"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1",
+		"1.0.0", "1.0.1", "1.1.0", "1.10.0", "2.0.0-0", "2.0.0", "2.1.0", "2.1.1", "10.0.0",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			a, err := parseSemver(ordered[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := parseSemver(ordered[j])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := compareUint(uint64(i), uint64(j))
+			if got := compareSemver(a, b); got != want {
+				t.Errorf("compareSemver(%s, %s) = %d, want %d", a, b, got, want)
+			}
+		}
+	}
+
+	a, _ := parseSemver("1.0.0+build.1")
+	b, _ := parseSemver("1.0.0+build.2")
+	if got := compareSemver(a, b); got != 0 {
+		t.Errorf("build metadata changes the precedence: %d", got)
+	}
+}
+
+func TestSemverErrorShort(t *testing.T) {
+	_, err := parseSemver("1.-2.3")
+	if short := err.(semverError).Short(); short != "1.-2.3 negative number" {
+		t.Errorf("Short() = %q", short)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	bucketDeliveries    = "deliveries"
+	bucketBodyEdits     = "body_edits"
+	bucketNotifications = "notifications"
+	bucketAnnouncements = "announcements"
+	bucketPayloads      = "payloads"
+
+	// bucketMeta holds the schema version of the store
+	bucketMeta = "meta"
+	versionKey = "version"
+)
+
+// storeMigrations bring the data to the current schema, the n-th one upgrades version n to n+1.
+// New migrations are appended, the existing ones must never change.
+var storeMigrations = []func(tx *bolt.Tx) error{
+	func(tx *bolt.Tx) error {
+		return createBuckets(tx, bucketDeliveries, bucketBodyEdits, bucketNotifications, bucketAnnouncements)
+	},
+	func(tx *bolt.Tx) error {
+		return createBuckets(tx, bucketPayloads)
+	},
+}
+
+// db records what the bot has already done, it is only kept until restart unless STORE_PATH is set.
+var db = newMemoryStore()
+
+// store is a small key-value store of JSON values grouped into buckets, kept in a bbolt database.
+// Every write is a transaction of its own which only touches the written keys.
+type store struct {
+	bolt *bolt.DB
+}
+
+// newMemoryStore opens a store in a temporary file which is removed right away,
+// it lives as long as the process keeps it open.
+func newMemoryStore() *store {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			logger.withError(err).warnf("failed to remove temporary store")
+		}
+	}()
+
+	s, err := openStore(filepath.Join(dir, "store.db"))
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// openStore opens the store at path, creating it if it does not exist yet, and migrates it to the current schema.
+func openStore(path string) (*store, error) {
+	// an other process holding the store blocks the open, it fails instead of waiting forever
+	b, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store %s: %s", path, err)
+	}
+
+	s := &store{bolt: b}
+	if err := b.Update(migrate); err != nil {
+		_ = b.Close()
+		return nil, fmt.Errorf("store %s: %s", path, err)
+	}
+	return s, nil
+}
+
+// openStoreFromEnv opens the store at STORE_PATH, or a temporary one if it is not set.
+// STORE_PATH is required if a steplib announces releases on Discourse, a restart would post them again.
+func openStoreFromEnv(steplibs *steplibRegistry) (*store, error) {
+	path := os.Getenv("STORE_PATH")
+	if path != "" {
+		return openStore(path)
+	}
+
+	for _, lib := range steplibs.byName {
+		if lib.Discourse.APIKey != "" {
+			return nil, fmt.Errorf("STORE_PATH has to be set, %s announces releases on Discourse", lib.fullName())
+		}
+	}
+	logger.warnf("STORE_PATH is not set, processed events are only remembered until restart")
+	return newMemoryStore(), nil
+}
+
+func (s *store) close() error {
+	return s.bolt.Close()
+}
+
+func migrate(tx *bolt.Tx) error {
+	meta, err := tx.CreateBucketIfNotExists([]byte(bucketMeta))
+	if err != nil {
+		return err
+	}
+
+	version := 0
+	if raw := meta.Get([]byte(versionKey)); raw != nil {
+		if version, err = strconv.Atoi(string(raw)); err != nil {
+			return fmt.Errorf("invalid schema version %q", raw)
+		}
+	}
+	if version > len(storeMigrations) {
+		return fmt.Errorf("schema version %d is newer than the supported %d", version, len(storeMigrations))
+	}
+
+	for ; version < len(storeMigrations); version++ {
+		if err := storeMigrations[version](tx); err != nil {
+			return fmt.Errorf("migration to version %d failed: %s", version+1, err)
+		}
+	}
+	return meta.Put([]byte(versionKey), []byte(strconv.Itoa(version)))
+}
+
+func createBuckets(tx *bolt.Tx, names ...string) error {
+	for _, name := range names {
+		if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func bucket(tx *bolt.Tx, name string) (*bolt.Bucket, error) {
+	b := tx.Bucket([]byte(name))
+	if b == nil || name == bucketMeta {
+		return nil, fmt.Errorf("unknown store bucket: %s", name)
+	}
+	return b, nil
+}
+
+// get loads the value of the key into v, found is false if the key is not set.
+func (s *store) get(bucketName, key string, v interface{}) (found bool, err error) {
+	err = s.bolt.View(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, bucketName)
+		if err != nil {
+			return err
+		}
+
+		raw := b.Get([]byte(key))
+		if raw == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(raw, v)
+	})
+	return found, err
+}
+
+func (s *store) put(bucketName, key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return s.bolt.Update(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, bucketName)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), raw)
+	})
+}
+
+// putIfAbsent sets the key only if it is not set yet, stored is false if it was already set.
+// It lets concurrent callers claim a key, only one of them gets stored true.
+func (s *store) putIfAbsent(bucketName, key string, v interface{}) (stored bool, err error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+
+	err = s.bolt.Update(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, bucketName)
+		if err != nil {
+			return err
+		}
+		if b.Get([]byte(key)) != nil {
+			return nil
+		}
+		stored = true
+		return b.Put([]byte(key), raw)
+	})
+	return stored && err == nil, err
+}
+
+// list returns every value of the bucket by key.
+func (s *store) list(bucketName string) (map[string]json.RawMessage, error) {
+	values := map[string]json.RawMessage{}
+	err := s.bolt.View(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, bucketName)
+		if err != nil {
+			return err
+		}
+
+		// the values are only valid during the transaction
+		return b.ForEach(func(key, raw []byte) error {
+			values[string(key)] = append(json.RawMessage{}, raw...)
+			return nil
+		})
+	})
+	return values, err
+}
+
+func (s *store) delete(bucketName, key string) error {
+	return s.deleteKeys(bucketName, []string{key})
+}
+
+// deleteKeys removes the keys from the bucket in a single transaction.
+func (s *store) deleteKeys(bucketName string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	return s.bolt.Update(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, bucketName)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
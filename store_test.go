@@ -0,0 +1,272 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func tempStorePath(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "store.db")
+}
+
+func TestStorePersists(t *testing.T) {
+	path := tempStorePath(t)
+
+	s, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.put(bucketAnnouncements, "key", announcement{Title: "Step 1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.put("unknown", "key", true); err == nil {
+		t.Error("put into an unknown bucket succeeded")
+	}
+	if err := s.put(bucketMeta, versionKey, 99); err == nil {
+		t.Error("put into the meta bucket succeeded")
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := reopened.close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	var posted announcement
+	found, err := reopened.get(bucketAnnouncements, "key", &posted)
+	if err != nil || !found || posted.Title != "Step 1.0.0" {
+		t.Errorf("get after reopen = %+v, %v, %v", posted, found, err)
+	}
+
+	if err := reopened.deleteKeys(bucketAnnouncements, []string{"key", "missing"}); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := reopened.get(bucketAnnouncements, "key", &posted); err != nil || found {
+		t.Errorf("get after delete = %v, %v", found, err)
+	}
+}
+
+func TestStorePutIfAbsentClaimsOnce(t *testing.T) {
+	s := newMemoryStore()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	claimed := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stored, err := s.putIfAbsent(bucketDeliveries, "delivery", true)
+			if err != nil {
+				t.Error(err)
+			}
+			if stored {
+				mu.Lock()
+				claimed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if claimed != 1 {
+		t.Errorf("claimed %d times, want once", claimed)
+	}
+}
+
+func TestClaimDeliveryReclaimsFailed(t *testing.T) {
+	defer func(previous *store) { db = previous }(db)
+	db = newMemoryStore()
+
+	lib := defaultSteplib()
+	pr := pullRequestModel{Action: "opened", Number: 1}
+
+	for i, want := range []bool{true, false} {
+		claimed, err := claimDelivery("delivery", &lib, pr)
+		if err != nil || claimed != want {
+			t.Fatalf("claim %d = %v, %v, want %v", i, claimed, err, want)
+		}
+	}
+
+	finishDelivery("delivery", deliveryDone)
+	if claimed, err := claimDelivery("delivery", &lib, pr); err != nil || claimed {
+		t.Fatalf("claim of a done delivery = %v, %v, want false", claimed, err)
+	}
+
+	finishDelivery("delivery", deliveryFailed)
+	claimed, err := claimDelivery("delivery", &lib, pr)
+	if err != nil || !claimed {
+		t.Fatalf("claim of a failed delivery = %v, %v, want true", claimed, err)
+	}
+
+	var record deliveryRecord
+	if _, err := db.get(bucketDeliveries, "delivery", &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Status != deliveryQueued || len(record.Log) < 2 {
+		t.Errorf("reclaimed record = %+v, want queued with the previous log kept", record)
+	}
+}
+
+func TestFailInterruptedDeliveries(t *testing.T) {
+	defer func(previous *store) { db = previous }(db)
+	db = newMemoryStore()
+
+	lib := defaultSteplib()
+	for _, id := range []string{"interrupted", "done"} {
+		if claimed, err := claimDelivery(id, &lib, pullRequestModel{Action: "opened", Number: 1}); err != nil || !claimed {
+			t.Fatalf("claim %s = %v, %v", id, claimed, err)
+		}
+	}
+	finishDelivery("done", deliveryDone)
+
+	// the process restarted before the job of the interrupted delivery finished
+	failed, err := failInterruptedDeliveries()
+	if err != nil || failed != 1 {
+		t.Fatalf("failInterruptedDeliveries = %d, %v, want 1", failed, err)
+	}
+
+	for id, want := range map[string]string{"interrupted": deliveryFailed, "done": deliveryDone} {
+		var record deliveryRecord
+		if _, err := db.get(bucketDeliveries, id, &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Status != want {
+			t.Errorf("%s status = %s, want %s", id, record.Status, want)
+		}
+	}
+
+	// so GitHub's redelivery of it is processed
+	if claimed, err := claimDelivery("interrupted", &lib, pullRequestModel{Action: "opened", Number: 1}); err != nil || !claimed {
+		t.Errorf("claim of the interrupted delivery = %v, %v, want true", claimed, err)
+	}
+}
+
+// writeStore creates a bbolt database at path with the buckets, at the schema version if it is not empty.
+func writeStore(t *testing.T, path, version string, buckets map[string]map[string]string) {
+	b, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	err = b.Update(func(tx *bolt.Tx) error {
+		if version != "" {
+			meta, err := tx.CreateBucket([]byte(bucketMeta))
+			if err != nil {
+				return err
+			}
+			if err := meta.Put([]byte(versionKey), []byte(version)); err != nil {
+				return err
+			}
+		}
+		for name, values := range buckets {
+			bucket, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			for key, value := range values {
+				if err := bucket.Put([]byte(key), []byte(value)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenStoreRejectsNewerVersion(t *testing.T) {
+	path := tempStorePath(t)
+	writeStore(t, path, "99", nil)
+
+	if _, err := openStore(path); err == nil || !strings.Contains(err.Error(), "schema version 99") {
+		t.Errorf("openStore = %v, want a schema version error", err)
+	}
+}
+
+func TestOpenStoreMigrates(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		version string
+		buckets map[string]map[string]string
+	}{
+		{"new file", "", nil},
+		{"version 0", "0", nil},
+		{"version 1", "1", map[string]map[string]string{
+			bucketDeliveries: {"kept": `{"id":"kept"}`}, bucketBodyEdits: {}, bucketNotifications: {}, bucketAnnouncements: {},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := tempStorePath(t)
+			if tc.version != "" {
+				writeStore(t, path, tc.version, tc.buckets)
+			}
+
+			s, err := openStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := s.close(); err != nil {
+					t.Error(err)
+				}
+			}()
+
+			for _, bucket := range []string{bucketDeliveries, bucketBodyEdits, bucketNotifications, bucketAnnouncements, bucketPayloads} {
+				if _, err := s.list(bucket); err != nil {
+					t.Error(err)
+				}
+			}
+
+			err = s.bolt.View(func(tx *bolt.Tx) error {
+				if version := string(tx.Bucket([]byte(bucketMeta)).Get([]byte(versionKey))); version != "2" {
+					t.Errorf("saved version = %s, want %d", version, len(storeMigrations))
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.buckets != nil {
+				var record deliveryRecord
+				if found, err := s.get(bucketDeliveries, "kept", &record); err != nil || !found {
+					t.Errorf("delivery lost in the migration: %v, %v", found, err)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenStoreFromEnvRequiresPathForDiscourse(t *testing.T) {
+	t.Setenv("STORE_PATH", "")
+
+	lib := defaultSteplib()
+	steplibs := &steplibRegistry{byName: map[string]*steplib{"bitrise-io/bitrise-steplib": &lib}, defaultLib: &lib}
+	if _, err := openStoreFromEnv(steplibs); err != nil {
+		t.Errorf("openStoreFromEnv without Discourse = %v", err)
+	}
+
+	lib.Discourse.APIKey = "key"
+	if _, err := openStoreFromEnv(steplibs); err == nil {
+		t.Error("openStoreFromEnv with Discourse and without STORE_PATH succeeded")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// maxTagDepth limits how many annotated tag objects are followed, tags can point at other tags.
+const maxTagDepth = 5
+
+type githubObject struct {
+	Type string `json:"type"`
+	SHA  string `json:"sha"`
+}
+
+type githubRef struct {
+	Ref    string       `json:"ref"`
+	Object githubObject `json:"object"`
+}
+
+type githubTagObject struct {
+	SHA    string       `json:"sha"`
+	Object githubObject `json:"object"`
+}
+
+// tagTarget describes what a tag resolves to.
+type tagTarget struct {
+	// SHA is the object the tag finally points at, a commit unless Type says otherwise.
+	SHA  string
+	Type string
+	// TagObjects are the SHAs of the annotated tag objects followed to reach SHA, empty for lightweight tags.
+	TagObjects []string
+}
+
+func (t tagTarget) Annotated() bool {
+	return len(t.TagObjects) > 0
+}
+
+func (t tagTarget) String() string {
+	if t.Annotated() {
+		return fmt.Sprintf("%s %s (via annotated tag %s)", t.Type, t.SHA, strings.Join(t.TagObjects, " → "))
+	}
+	return fmt.Sprintf("%s %s", t.Type, t.SHA)
+}
+
+// githubAPIRepoURL maps a https://github.com/owner/repo source to its API URL, other sources are rejected.
+func githubAPIRepoURL(giturl string) (string, error) {
+	invalid := fmt.Errorf("source %s is not a https://github.com/owner/repo URL", giturl)
+	if !strings.HasPrefix(giturl, "https://github.com/") {
+		return "", invalid
+	}
+	path := strings.TrimSuffix(strings.TrimPrefix(giturl, "https://github.com/"), ".git")
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 || strings.ContainsAny(path, "?#%") {
+		return "", invalid
+	}
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			return "", invalid
+		}
+	}
+	return "https://" + githubAPIHost + "/repos/" + path, nil
+}
+
+// resolveGithubTag looks up the single tag ref and dereferences annotated tags down to the object they point at,
+// found is false if the repository has no such tag.
+func resolveGithubTag(c *githubClient, giturl string, tag string) (target tagTarget, found bool, err error) {
+	repoURL, err := githubAPIRepoURL(giturl)
+	if err != nil {
+		return tagTarget{}, false, err
+	}
+
+	var raw json.RawMessage
+	found, err = httpLoadJSONIfExists(c, repoURL+"/git/refs/tags/"+url.PathEscape(tag), &raw)
+	if err != nil || !found {
+		return tagTarget{}, false, err
+	}
+
+	ref, found, err := exactTagRef(raw, tag)
+	if err != nil || !found {
+		return tagTarget{}, false, err
+	}
+
+	object := ref.Object
+	for depth := 0; object.Type == "tag"; depth++ {
+		if depth == maxTagDepth {
+			return tagTarget{}, false, fmt.Errorf("tag %s is nested deeper than %d annotated tags", tag, maxTagDepth)
+		}
+
+		target.TagObjects = append(target.TagObjects, object.SHA)
+
+		var tagObject githubTagObject
+		found, err := httpLoadJSONIfExists(c, repoURL+"/git/tags/"+object.SHA, &tagObject)
+		if err != nil {
+			return tagTarget{}, false, err
+		}
+		if !found {
+			return tagTarget{}, false, fmt.Errorf("annotated tag object %s of tag %s not found", object.SHA, tag)
+		}
+
+		object = tagObject.Object
+	}
+
+	target.SHA = object.SHA
+	target.Type = object.Type
+
+	return target, true, nil
+}
+
+// exactTagRef picks the ref of the tag from the git/refs response,
+// which is a list of every ref starting with the tag name if there is no exact match.
+func exactTagRef(raw json.RawMessage, tag string) (githubRef, bool, error) {
+	var refs []githubRef
+	if err := json.Unmarshal(raw, &refs); err != nil {
+		var ref githubRef
+		if err := json.Unmarshal(raw, &ref); err != nil {
+			return githubRef{}, false, err
+		}
+		refs = []githubRef{ref}
+	}
+
+	for _, ref := range refs {
+		if ref.Ref == "refs/tags/"+tag {
+			return ref, true, nil
+		}
+	}
+
+	return githubRef{}, false, nil
+}
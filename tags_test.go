@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func sha(n int) string {
+	return fmt.Sprintf("%040x", n)
+}
+
+// tagAPI serves git/refs/tags and git/tags of the steps-script repository from the given JSON responses by path.
+func tagAPI(t *testing.T, responses map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := responses[strings.TrimPrefix(r.URL.Path, "/repos/bitrise-steplib/steps-script")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			body = `{"message":"Not Found"}`
+		}
+		if _, err := w.Write([]byte(body)); err != nil {
+			t.Error(err)
+		}
+	}))
+}
+
+func ref(tag, objectType, objectSHA string) string {
+	return fmt.Sprintf(`{"ref":"refs/tags/%s","object":{"type":"%s","sha":"%s"}}`, tag, objectType, objectSHA)
+}
+
+func tagObject(objectSHA, objectType, target string) string {
+	return fmt.Sprintf(`{"sha":"%s","object":{"type":"%s","sha":"%s"}}`, objectSHA, objectType, target)
+}
+
+func TestResolveGithubTag(t *testing.T) {
+	responses := map[string]string{
+		"/git/refs/tags/1.0.0": ref("1.0.0", "commit", sha(1)),
+		// no exact match: GitHub lists the refs starting with the name
+		"/git/refs/tags/1.1":   "[" + ref("1.1.0", "commit", sha(2)) + "," + ref("1.1.1", "commit", sha(3)) + "]",
+		"/git/refs/tags/1.2.0": "[" + ref("1.2.0", "commit", sha(4)) + "," + ref("1.2.0-beta", "commit", sha(5)) + "]",
+
+		"/git/refs/tags/2.0.0":   ref("2.0.0", "tag", sha(20)),
+		"/git/tags/" + sha(20):   tagObject(sha(20), "commit", sha(1)),
+		"/git/refs/tags/2.1.0":   ref("2.1.0", "tag", sha(21)),
+		"/git/tags/" + sha(21):   tagObject(sha(21), "tag", sha(20)),
+		"/git/refs/tags/3.0.0":   ref("3.0.0", "tree", sha(30)),
+		"/git/refs/tags/4.0.0":   ref("4.0.0", "tag", sha(40)),
+		"/git/refs/tags/5.0.0":   ref("5.0.0", "tag", sha(50)),
+		"/git/refs/tags/bad-ref": `"not a ref"`,
+	}
+	// 5.0.0 is nested one level deeper than followed
+	for i := 0; i <= maxTagDepth; i++ {
+		responses["/git/tags/"+sha(50+i)] = tagObject(sha(50+i), "tag", sha(51+i))
+	}
+
+	server := tagAPI(t, responses)
+	defer server.Close()
+	c := newTestGithubClient(server, basicAuth{})
+
+	for _, tc := range []struct {
+		tag        string
+		found      bool
+		target     tagTarget
+		errMessage string
+	}{
+		{tag: "1.0.0", found: true, target: tagTarget{SHA: sha(1), Type: "commit"}},
+		{tag: "1.1"},
+		{tag: "1.2.0", found: true, target: tagTarget{SHA: sha(4), Type: "commit"}},
+		{tag: "2.0.0", found: true, target: tagTarget{SHA: sha(1), Type: "commit", TagObjects: []string{sha(20)}}},
+		{tag: "2.1.0", found: true, target: tagTarget{SHA: sha(1), Type: "commit", TagObjects: []string{sha(21), sha(20)}}},
+		{tag: "3.0.0", found: true, target: tagTarget{SHA: sha(30), Type: "tree"}},
+		{tag: "4.0.0", errMessage: "annotated tag object " + sha(40) + " of tag 4.0.0 not found"},
+		{tag: "5.0.0", errMessage: fmt.Sprintf("nested deeper than %d annotated tags", maxTagDepth)},
+		{tag: "9.9.9"},
+		{tag: "bad-ref", errMessage: "cannot unmarshal"},
+	} {
+		t.Run(tc.tag, func(t *testing.T) {
+			target, found, err := resolveGithubTag(c, "https://github.com/bitrise-steplib/steps-script.git", tc.tag)
+			if tc.errMessage != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.errMessage) {
+					t.Fatalf("err = %v, want %q", err, tc.errMessage)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != tc.found || target.String() != tc.target.String() {
+				t.Errorf("resolveGithubTag = %s, %v, want %s, %v", target, found, tc.target, tc.found)
+			}
+		})
+	}
+}
+
+func TestResolveGithubTagEscapesTagName(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	if _, found, err := resolveGithubTag(newTestGithubClient(server, basicAuth{}), "https://github.com/bitrise-steplib/steps-script", "1.0.0?x=1#y"); err != nil || found {
+		t.Fatalf("resolveGithubTag = %v, %v", found, err)
+	}
+	if len(paths) != 1 || paths[0] != "/repos/bitrise-steplib/steps-script/git/refs/tags/1.0.0%3Fx=1%23y" {
+		t.Errorf("requested %q", paths)
+	}
+}
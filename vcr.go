@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	vcrRecord = "record"
+	vcrReplay = "replay"
+)
+
+// vcrKeyHeaders are the request headers which change the response, conditional requests get their own fixture
+// so a recorded 304 is only replayed for the revalidation it answered.
+var vcrKeyHeaders = []string{"If-None-Match", "If-Modified-Since"}
+
+// vcrDroppedHeaders are never written to the fixtures.
+// Content-Length is dropped as the redacted body can be shorter.
+var vcrDroppedHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "Content-Length"}
+
+// httpTransport is the transport of every outgoing request, GitHub and Discourse alike.
+var httpTransport = newTransportFromEnv()
+
+// vcrFixture is a recorded request/response pair, with the credentials redacted.
+type vcrFixture struct {
+	Request struct {
+		Method string      `json:"method"`
+		URL    string      `json:"url"`
+		Header http.Header `json:"header,omitempty"`
+		Body   string      `json:"body,omitempty"`
+	} `json:"request"`
+	Response struct {
+		StatusCode int         `json:"status_code"`
+		Header     http.Header `json:"header,omitempty"`
+		Body       string      `json:"body,omitempty"`
+	} `json:"response"`
+}
+
+// vcrTransport records the interactions into fixture files or replays them from there without network access.
+// A fixture is named after the hash of the redacted method, URL, body and conditional headers,
+// so a request finds its recording whatever credentials it carries.
+type vcrTransport struct {
+	mode string
+	dir  string
+	next http.RoundTripper
+}
+
+// newTransportFromEnv returns a vcrTransport if VCR_MODE is record or replay, the fixtures are in VCR_DIR.
+func newTransportFromEnv() http.RoundTripper {
+	mode := os.Getenv("VCR_MODE")
+	if mode != vcrRecord && mode != vcrReplay {
+		return http.DefaultTransport
+	}
+
+	dir := os.Getenv("VCR_DIR")
+	if dir == "" {
+		dir = "fixtures"
+	}
+
+	return &vcrTransport{mode: mode, dir: dir, next: http.DefaultTransport}
+}
+
+func (t *vcrTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		if err := req.Body.Close(); err != nil {
+			return nil, err
+		}
+		body = b
+
+		// the request of the caller must not be modified, the body is replaced on a copy
+		copied := *req
+		copied.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req = &copied
+	}
+
+	redactedURL := redactURL(req.URL)
+	redactedBody := redactRequestBody(req.Header.Get("Content-Type"), body)
+	pth := filepath.Join(t.dir, vcrFixtureName(req, redactedURL, redactedBody))
+
+	if t.mode == vcrReplay {
+		return t.replay(req, pth)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := resp.Body.Close(); err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+
+	var fixture vcrFixture
+	fixture.Request.Method = req.Method
+	fixture.Request.URL = redactedURL
+	fixture.Request.Header = redactHeader(req.Header)
+	fixture.Request.Body = redactedBody
+	fixture.Response.StatusCode = resp.StatusCode
+	fixture.Response.Header = redactHeader(resp.Header)
+	fixture.Response.Body = redactResponseBody(respBody)
+
+	if err := writeFixture(pth, fixture); err != nil {
+		logger.with("url", redactedURL).withError(err).errorf("failed to record fixture")
+	}
+
+	return resp, nil
+}
+
+// vcrFixtureName hashes the redacted method, URL and body, and the vcrKeyHeaders if the request has them.
+func vcrFixtureName(req *http.Request, redactedURL, redactedBody string) string {
+	key := req.Method + " " + redactedURL
+	for _, name := range vcrKeyHeaders {
+		if value := req.Header.Get(name); value != "" {
+			key += "\n" + name + ": " + value
+		}
+	}
+	key += "\n" + redactedBody
+	return fmt.Sprintf("%s-%x.json", strings.ToLower(req.Method), sha1.Sum([]byte(key)))
+}
+
+func (t *vcrTransport) replay(req *http.Request, pth string) (*http.Response, error) {
+	b, err := ioutil.ReadFile(pth)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no fixture recorded for %s %s at %s", req.Method, redactURL(req.URL), pth)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var fixture vcrFixture
+	if err := json.Unmarshal(b, &fixture); err != nil {
+		return nil, fmt.Errorf("failed to parse fixture %s: %s", pth, err)
+	}
+
+	header := fixture.Response.Header
+	if header == nil {
+		header = http.Header{}
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", fixture.Response.StatusCode, http.StatusText(fixture.Response.StatusCode)),
+		StatusCode:    fixture.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(fixture.Response.Body)),
+		ContentLength: int64(len(fixture.Response.Body)),
+		Request:       req,
+	}, nil
+}
+
+func writeFixture(pth string, fixture vcrFixture) error {
+	b, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pth, append(b, '\n'), 0644)
+}
+
+// redactURL drops the user info and the sensitive query parameters.
+func redactURL(u *url.URL) string {
+	redacted := *u
+	redacted.User = nil
+
+	query := redacted.Query()
+	for key := range query {
+		if isRedactedKey(key) {
+			query.Set(key, "[REDACTED]")
+		}
+	}
+	redacted.RawQuery = query.Encode()
+
+	return redacted.String()
+}
+
+// redactRequestBody redacts the sensitive fields of form and JSON bodies, other bodies are kept as they are.
+func redactRequestBody(contentType string, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		form, err := url.ParseQuery(string(body))
+		if err == nil {
+			for key := range form {
+				if isRedactedKey(key) {
+					form.Set(key, "[REDACTED]")
+				}
+			}
+			return form.Encode()
+		}
+	}
+
+	if redacted, err := redactPayload(body); err == nil {
+		return string(redacted)
+	}
+
+	return redactText(string(body))
+}
+
+func redactResponseBody(body []byte) string {
+	if redacted, err := redactPayload(body); err == nil {
+		body = redacted
+	}
+	return redactText(string(body))
+}
+
+func redactHeader(header http.Header) http.Header {
+	redacted := http.Header{}
+	for key, values := range header {
+		dropped := false
+		for _, name := range vcrDroppedHeaders {
+			if strings.EqualFold(key, name) {
+				dropped = true
+			}
+		}
+		if !dropped {
+			redacted[key] = values
+		}
+	}
+	return redacted
+}
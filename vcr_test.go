@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// vcrPR is the steplib PR the fixtures of testdata/vcr were taken from.
+const vcrPR = 4242
+
+// replayFixtures routes every outgoing request to the fixtures of testdata/vcr, the returned func restores the transport.
+func replayFixtures() func() {
+	previous := httpTransport
+	httpTransport = &vcrTransport{mode: vcrReplay, dir: "testdata/vcr"}
+	return func() { httpTransport = previous }
+}
+
+func replaySteplib() *steplib {
+	lib := defaultSteplib()
+	lib.client = newGithubClient(basicAuth{})
+	lib.github = restGithub{client: lib.client, lib: &lib}
+	return &lib
+}
+
+func TestReplayParseStepsOfLargePR(t *testing.T) {
+	defer replayFixtures()()
+
+	lib := replaySteplib()
+
+	// the PR changes 131 files on two pages, most of them removed step versions
+	pr, err := lib.github.pullRequest(vcrPR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps, err := parseSteps(lib, vcrPR, pr.Head.SHA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, step := range steps {
+		got = append(got, fmt.Sprintf("%s@%s %s %s", step.ID, step.Version, step.Status, step.Step.Source.Git))
+	}
+	want := []string{
+		"script@1.2.0 added https://github.com/bitrise-steplib/steps-script.git",
+		"git-clone@8.0.0 renamed https://github.com/bitrise-steplib/steps-git-clone.git",
+		"deploy-to-bitrise-io@2.1.0 modified https://github.com/bitrise-steplib/steps-deploy-to-bitrise-io.git",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("steps:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestReplayReleaseBody(t *testing.T) {
+	defer replayFixtures()()
+	lib := replaySteplib()
+
+	body, err := lib.github.releaseBody("https://github.com/bitrise-steplib/steps-script.git", "1.2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "### Changes\r\n* Run the script with `bash -e` by default" {
+		t.Errorf("body = %q", body)
+	}
+
+	if _, err := lib.github.releaseBody("https://github.com/bitrise-steplib/steps-script.git", "1.3.0"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("missing release = %v, want a not found error", err)
+	}
+}
+
+func TestReplayCreateDiscourseTopic(t *testing.T) {
+	defer replayFixtures()()
+
+	cfg := discourseConfig{URL: "https://discuss.bitrise.io", APIKey: "any-key", APIUsername: "bitrise-bot", Category: "step-releases"}
+	body := "### Changes\r\n* Run the script with `bash -e` by default\n\n\nhttps://github.com/bitrise-steplib/steps-script/releases/1.2.0\r\n\r\n"
+
+	if err := createDiscourseTopic(cfg, "Script v1.2.0", body); err != nil {
+		t.Fatal(err)
+	}
+	if err := createDiscourseTopic(cfg, "Script v1.1.0", body); err == nil || !strings.Contains(err.Error(), "422") {
+		t.Errorf("duplicate topic = %v, want a 422 error", err)
+	}
+}
+
+// TestRecordFixtures records the GitHub fixtures of the PR VCR_PR into VCR_DIR, it only runs with VCR_MODE=record,
+// see testdata/vcr/README.md. The Discourse fixtures are not recorded, that would post a topic.
+func TestRecordFixtures(t *testing.T) {
+	if os.Getenv("VCR_MODE") != vcrRecord {
+		t.Skip("VCR_MODE is not record")
+	}
+	pr, err := strconv.Atoi(os.Getenv("VCR_PR"))
+	if err != nil {
+		t.Fatalf("invalid VCR_PR: %s", err)
+	}
+
+	lib := defaultSteplib()
+	lib.client = newGithubClient(basicAuth{user: os.Getenv("GITHUB_USER"), token: os.Getenv("GITHUB_ACCESS_TOKEN")})
+	lib.github = restGithub{client: lib.client, lib: &lib}
+
+	pullRequest, err := lib.github.pullRequest(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps, err := parseSteps(&lib, pr, pullRequest.Head.SHA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range steps {
+		t.Logf("%s@%s %s %s", step.ID, step.Version, step.Status, step.Step.Source.Git)
+		if _, err := lib.github.releaseBody(step.Step.Source.Git, step.Version); err != nil {
+			t.Logf("release of %s@%s: %s", step.ID, step.Version, err)
+		}
+	}
+}
+
+type etagTransport struct {
+	requests int
+}
+
+func (t *etagTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests++
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Etag": {`"v1"`}}, Body: ioutil.NopCloser(strings.NewReader(`{"tag_name":"1.0.0"}`)), Request: req}
+	if req.Header.Get("If-None-Match") == `"v1"` {
+		resp.StatusCode = http.StatusNotModified
+		resp.Body = ioutil.NopCloser(strings.NewReader(""))
+	}
+	return resp, nil
+}
+
+func TestVCRKeepsConditionalRequestsApart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vcr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	const releaseURL = "https://api.github.com/repos/bitrise-steplib/steps-script/releases/tags/1.0.0"
+	get := func(transport http.RoundTripper, header http.Header) *http.Response {
+		req, err := http.NewRequest("GET", releaseURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = header
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	upstream := &etagTransport{}
+	recorder := &vcrTransport{mode: vcrRecord, dir: dir, next: upstream}
+	get(recorder, http.Header{})
+	get(recorder, http.Header{"If-None-Match": {`"v1"`}})
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upstream.requests != 2 || len(files) != 2 {
+		t.Fatalf("%d requests recorded into %d fixtures, want 2 into 2", upstream.requests, len(files))
+	}
+
+	replayer := &vcrTransport{mode: vcrReplay, dir: dir}
+	if resp := get(replayer, http.Header{}); resp.StatusCode != http.StatusOK {
+		t.Errorf("unconditional replay = %d, want 200", resp.StatusCode)
+	}
+	if resp := get(replayer, http.Header{"If-None-Match": {`"v1"`}}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("conditional replay = %d, want 304", resp.StatusCode)
+	}
+	req, err := http.NewRequest("GET", releaseURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-None-Match", `"v2"`)
+	if _, err := replayer.RoundTrip(req); err == nil {
+		t.Error("replayed a 304 for a revalidation it was not recorded for")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	maxVerdicts = 1000
+	// passedVerdictTTL is long as the commit of a passing check does not change, while failedVerdictTTL is short
+	// since the contributor can still fix a failure without pushing to the PR, by pushing the missing tag for example.
+	passedVerdictTTL = 24 * time.Hour
+	failedVerdictTTL = 5 * time.Minute
+)
+
+var verdicts = newVerdictCache()
+
+type verdictKey struct {
+	Repo    string
+	PR      int
+	HeadSHA string
+}
+
+type verdict struct {
+	Results []stepResult
+	Badge   badge
+	Passed  bool
+	Expires time.Time
+}
+
+type verdictCache struct {
+	mu      sync.Mutex
+	entries map[verdictKey]verdict
+}
+
+func newVerdictCache() *verdictCache {
+	return &verdictCache{entries: map[verdictKey]verdict{}}
+}
+
+func newVerdict(results []stepResult, now time.Time) verdict {
+	v := verdict{Results: results, Badge: badgeForResults(results), Passed: true}
+	for _, result := range results {
+		if len(result.Failures) > 0 {
+			v.Passed = false
+		}
+	}
+
+	if v.Passed {
+		v.Expires = now.Add(passedVerdictTTL)
+	} else {
+		v.Expires = now.Add(failedVerdictTTL)
+	}
+	return v
+}
+
+// failureCode is the code of the first failure, the reason the badge is red.
+func (v verdict) failureCode() string {
+	for _, result := range v.Results {
+		if len(result.Failures) > 0 {
+			return result.Failures[0].Code
+		}
+	}
+	return ""
+}
+
+func (c *verdictCache) get(key verdictKey) (verdict, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.entries[key]
+	if !ok || time.Now().After(v.Expires) {
+		return verdict{}, false
+	}
+	return v, true
+}
+
+func (c *verdictCache) put(key verdictKey, v verdict) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = v
+
+	if len(c.entries) <= maxVerdicts {
+		return
+	}
+
+	// drop the expired ones, or the one closest to expiry if all of them are still valid
+	now := time.Now()
+	var oldest *verdictKey
+	for k, e := range c.entries {
+		if now.After(e.Expires) {
+			delete(c.entries, k)
+			continue
+		}
+		if oldest == nil || e.Expires.Before(c.entries[*oldest].Expires) {
+			candidate := k
+			oldest = &candidate
+		}
+	}
+	if len(c.entries) > maxVerdicts && oldest != nil {
+		delete(c.entries, *oldest)
+	}
+}
+
+// invalidate drops every verdict of the PR, whatever head they were computed for.
+func (c *verdictCache) invalidate(repo string, pr int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.entries {
+		if key.Repo == repo && key.PR == pr {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// storeVerdict caches the results computed for the PR head, so the badge does not need to recompute them.
+func storeVerdict(lib *steplib, pr int, headSHA string, results []stepResult) verdict {
+	v := newVerdict(results, time.Now())
+	if headSHA != "" {
+		verdicts.put(verdictKey{Repo: lib.fullName(), PR: pr, HeadSHA: headSHA}, v)
+	}
+	return v
+}
+
+// prVerdict returns the verdict of the current PR head, it is computed and cached if it is not cached yet.
+func prVerdict(lib *steplib, pr int) (verdict, error) {
+	headSHA, err := loadPRHeadSHA(lib, pr)
+	if err != nil {
+		return verdict{}, err
+	}
+
+	if v, ok := verdicts.get(verdictKey{Repo: lib.fullName(), PR: pr, HeadSHA: headSHA}); ok {
+		return v, nil
+	}
+
+	results, err := checkPR(lib, pr, headSHA)
+	if err != nil {
+		return verdict{}, err
+	}
+
+	return storeVerdict(lib, pr, headSHA, results), nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	failureVersionDuplicate = "version-duplicate"
+	failureVersionDowngrade = "version-downgrade"
+	warningVersionJump      = "version-unusual-jump"
+)
+
+// checkVersionOrdering compares a newly added step version with the versions already released in the steplib.
+// Duplicates and downgrades are failures, skipped versions are reported as warnings only.
+func checkVersionOrdering(lib *steplib, step stepFile, version semver) (failures []checkFailure, warnings []checkFailure, err error) {
+	if step.Status != "added" {
+		// an existing version is being modified, its place in the history is already settled
+		return nil, nil, nil
+	}
+
+	existing, exists, err := listStepVersions(lib, step.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !exists {
+		return nil, nil, nil
+	}
+
+	var latest *semver
+	for _, name := range existing {
+		if name == step.Version {
+			failures = append(failures, checkFailure{
+				Code:    failureVersionDuplicate,
+				Title:   "Version already exists",
+				Message: fmt.Sprintf("version %s of %s already exists in the steplib", step.Version, step.ID),
+				Short:   fmt.Sprintf("%s already exists", step.Version),
+				Line:    1,
+			})
+			return failures, nil, nil
+		}
+
+		v, err := parseSemver(name)
+		if err != nil {
+			// not a version directory, like assets
+			continue
+		}
+
+		if latest == nil || compareSemver(v, *latest) > 0 {
+			latestVersion := v
+			latest = &latestVersion
+		}
+	}
+
+	if latest == nil {
+		return nil, nil, nil
+	}
+
+	if compareSemver(version, *latest) < 0 {
+		failures = append(failures, checkFailure{
+			Code:    failureVersionDowngrade,
+			Title:   "Version is lower than the latest release",
+			Message: fmt.Sprintf("version %s is lower than the latest released version %s of %s", step.Version, latest, step.ID),
+			Short:   fmt.Sprintf("%s < latest %s", step.Version, latest),
+			Line:    1,
+		})
+		return failures, nil, nil
+	}
+
+	if expected := nextVersions(*latest); !isExpectedBump(version, expected) {
+		var names []string
+		for _, v := range expected {
+			names = append(names, v.String())
+		}
+
+		warnings = append(warnings, checkFailure{
+			Code:    warningVersionJump,
+			Title:   "Unusual version jump",
+			Message: fmt.Sprintf("version %s does not directly follow the latest released version %s of %s, expected one of %s", step.Version, latest, step.ID, strings.Join(names, ", ")),
+			Short:   fmt.Sprintf("%s → %s jump", latest, step.Version),
+			Line:    1,
+		})
+	}
+
+	return nil, warnings, nil
+}
+
+// nextVersions returns the patch, minor and major bump of the version, and the release of a pre-release version.
+func nextVersions(v semver) []semver {
+	var next []semver
+	if len(v.PreRelease) > 0 {
+		next = append(next, semver{Major: v.Major, Minor: v.Minor, Patch: v.Patch})
+	}
+
+	return append(next,
+		semver{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1},
+		semver{Major: v.Major, Minor: v.Minor + 1},
+		semver{Major: v.Major + 1},
+	)
+}
+
+// isExpectedBump tells if the version is one of the expected bumps, pre-releases of an expected bump are accepted too.
+func isExpectedBump(v semver, expected []semver) bool {
+	for _, e := range expected {
+		if v.Major == e.Major && v.Minor == e.Minor && v.Patch == e.Patch {
+			return true
+		}
+	}
+	return false
+}
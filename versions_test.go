@@ -0,0 +1,130 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckVersionOrdering(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		existing []string
+		version  string
+		status   string
+		failure  string
+		warning  string
+	}{
+		{name: "new step", version: "1.0.0"},
+		{name: "patch bump", existing: []string{"1.0.0", "1.2.0"}, version: "1.2.1"},
+		{name: "minor bump", existing: []string{"1.0.0", "1.2.0"}, version: "1.3.0"},
+		{name: "major bump", existing: []string{"1.0.0", "1.2.0"}, version: "2.0.0"},
+		{name: "duplicate", existing: []string{"1.0.0", "1.1.0"}, version: "1.1.0", failure: failureVersionDuplicate},
+		{name: "downgrade", existing: []string{"1.0.0", "1.2.0"}, version: "1.1.5", failure: failureVersionDowngrade},
+		{name: "downgrade below a numerically higher minor", existing: []string{"1.9.0", "1.10.0"}, version: "1.9.1", failure: failureVersionDowngrade},
+		{name: "bump of a numerically higher minor", existing: []string{"1.9.0", "1.10.0"}, version: "1.10.1"},
+		{name: "skipped major", existing: []string{"1.2.0"}, version: "3.0.0", warning: warningVersionJump},
+		{name: "skipped patch", existing: []string{"1.2.0"}, version: "1.2.2", warning: warningVersionJump},
+		{name: "minor bump without resetting the patch", existing: []string{"1.2.3"}, version: "1.3.3", warning: warningVersionJump},
+		{name: "release of the latest pre-release", existing: []string{"1.2.0", "2.0.0-beta.1"}, version: "2.0.0"},
+		{name: "next pre-release", existing: []string{"1.2.0", "2.0.0-beta.1"}, version: "2.0.0-beta.2"},
+		{name: "below the latest pre-release", existing: []string{"1.2.0", "2.0.0-beta.1"}, version: "1.3.0", failure: failureVersionDowngrade},
+		{name: "non semver dirs are skipped", existing: []string{"assets", "1.0.0", "latest"}, version: "1.0.1"},
+		{name: "only non semver dirs", existing: []string{"assets"}, version: "1.0.0"},
+		{name: "modified duplicate", existing: []string{"1.0.0", "1.1.0"}, version: "1.1.0", status: "modified"},
+		{name: "modified old version", existing: []string{"1.0.0", "1.1.0"}, version: "1.0.0", status: "modified"},
+		{name: "renamed version", existing: []string{"1.0.0"}, version: "3.0.0", status: "renamed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			github := newFakeGithub()
+			if tc.existing != nil {
+				github.addDir("steps/script", tc.existing...)
+			}
+			lib := newFakeSteplib(t, github)
+
+			status := tc.status
+			if status == "" {
+				status = "added"
+			}
+			version, err := parseSemver(tc.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			failures, warnings, err := checkVersionOrdering(lib, stepFile{ID: "script", Version: tc.version, Status: status}, version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := failureCodes(failures); !reflect.DeepEqual(got, codes(tc.failure)) {
+				t.Errorf("failures = %v, want %v", got, codes(tc.failure))
+			}
+			if got := failureCodes(warnings); !reflect.DeepEqual(got, codes(tc.warning)) {
+				t.Errorf("warnings = %v, want %v", got, codes(tc.warning))
+			}
+		})
+	}
+}
+
+func failureCodes(failures []checkFailure) []string {
+	var got []string
+	for _, failure := range failures {
+		got = append(got, failure.Code)
+	}
+	return got
+}
+
+func codes(code string) []string {
+	if code == "" {
+		return nil
+	}
+	return []string{code}
+}
+
+func TestNextVersions(t *testing.T) {
+	for version, want := range map[string][]string{
+		"1.2.3":        {"1.2.4", "1.3.0", "2.0.0"},
+		"0.9.0":        {"0.9.1", "0.10.0", "1.0.0"},
+		"2.0.0-beta.1": {"2.0.0", "2.0.1", "2.1.0", "3.0.0"},
+	} {
+		v, err := parseSemver(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, next := range nextVersions(v) {
+			got = append(got, next.String())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("nextVersions(%s) = %v, want %v", version, got, want)
+		}
+	}
+}
+
+func TestIsExpectedBump(t *testing.T) {
+	latest, err := parseSemver("1.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := nextVersions(latest)
+
+	for version, want := range map[string]bool{
+		"1.2.4":        true,
+		"1.3.0":        true,
+		"2.0.0":        true,
+		"2.0.0-rc.1":   true,
+		"1.2.4+build":  true,
+		"1.2.3":        false,
+		"1.2.5":        false,
+		"1.3.1":        false,
+		"3.0.0":        false,
+		"2.0.1-beta.1": false,
+	} {
+		v, err := parseSemver(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := isExpectedBump(v, expected); got != want {
+			t.Errorf("isExpectedBump(%s) = %v, want %v", version, got, want)
+		}
+	}
+}
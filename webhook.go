@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const signaturePrefix = "sha256="
+
+// webhookSecrets returns the configured webhook secrets, GITHUB_WEBHOOK_SECRET can hold a comma separated list
+// so the secret can be rotated without dropping deliveries signed with the previous one.
+func webhookSecrets() []string {
+	var secrets []string
+	for _, secret := range strings.Split(os.Getenv("GITHUB_WEBHOOK_SECRET"), ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+func verifySignature(payload []byte, signature string, secrets []string) error {
+	if len(secrets) == 0 {
+		return fmt.Errorf("GITHUB_WEBHOOK_SECRET is not set")
+	}
+
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return fmt.Errorf("missing or malformed X-Hub-Signature-256 header")
+	}
+
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, signaturePrefix))
+	if err != nil {
+		return fmt.Errorf("malformed X-Hub-Signature-256 header: %s", err)
+	}
+
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, []byte(secret))
+		if _, err := mac.Write(payload); err != nil {
+			return err
+		}
+		if hmac.Equal(got, mac.Sum(nil)) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("signature mismatch")
+}
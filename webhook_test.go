@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func sign(payload []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	if _, err := mac.Write(payload); err != nil {
+		panic(err)
+	}
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySignature(t *testing.T) {
+	payload := []byte(`{"action":"opened","number":1}`)
+
+	for _, tc := range []struct {
+		name      string
+		payload   []byte
+		signature string
+		secrets   []string
+		valid     bool
+	}{
+		{name: "valid signature", payload: payload, signature: sign(payload, "secret"), secrets: []string{"secret"}, valid: true},
+		{name: "tampered body", payload: []byte(`{"action":"opened","number":2}`), signature: sign(payload, "secret"), secrets: []string{"secret"}},
+		{name: "wrong secret", payload: payload, signature: sign(payload, "other"), secrets: []string{"secret"}},
+		{name: "missing header", payload: payload, signature: "", secrets: []string{"secret"}},
+		{name: "sha1 header", payload: payload, signature: "sha1=" + sign(payload, "secret")[len(signaturePrefix):], secrets: []string{"secret"}},
+		{name: "bad hex", payload: payload, signature: signaturePrefix + "zz", secrets: []string{"secret"}},
+		{name: "rotated secret", payload: payload, signature: sign(payload, "new"), secrets: []string{"old", "new"}, valid: true},
+		{name: "no secrets configured", payload: payload, signature: sign(payload, ""), secrets: nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := verifySignature(tc.payload, tc.signature, tc.secrets)
+			if tc.valid && err != nil {
+				t.Fatalf("expected valid signature, got: %s", err)
+			}
+			if !tc.valid && err == nil {
+				t.Fatal("expected the signature to be rejected")
+			}
+		})
+	}
+}
+
+func TestWebhookSecrets(t *testing.T) {
+	t.Setenv("GITHUB_WEBHOOK_SECRET", " old, ,new ")
+
+	secrets := webhookSecrets()
+	if len(secrets) != 2 || secrets[0] != "old" || secrets[1] != "new" {
+		t.Fatalf("unexpected secrets: %q", secrets)
+	}
+}